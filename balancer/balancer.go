@@ -0,0 +1,328 @@
+package balancer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	StrategyRoundRobin = "round_robin"
+	StrategyLeastConn  = "least_conn"
+	StrategyWeighted   = "weighted"
+)
+
+var ErrNoUpstream = errors.New("no healthy upstream")
+
+type HealthCheck struct {
+	Path               string        `yaml:"path"`
+	Interval           time.Duration `yaml:"interval"`
+	Timeout            time.Duration `yaml:"timeout"`
+	HealthyThreshold   int           `yaml:"healthy_threshold"`
+	UnhealthyThreshold int           `yaml:"unhealthy_threshold"`
+}
+
+// Outlier ejects an upstream for EjectionTime after ConsecutiveFailures
+// failed requests (transport errors or 5xx responses) in a row, but never
+// more than MaxEjectionPercent of the pool.
+type Outlier struct {
+	ConsecutiveFailures int           `yaml:"consecutive_failures"`
+	EjectionTime        time.Duration `yaml:"ejection_time"`
+	MaxEjectionPercent  int           `yaml:"max_ejection_percent"`
+}
+
+type Config struct {
+	Strategy    string           `yaml:"strategy"`
+	HealthCheck HealthCheck      `yaml:"health_check"`
+	Outlier     Outlier          `yaml:"outlier"`
+	Upstreams   []UpstreamConfig `yaml:"upstreams"`
+}
+
+type UpstreamConfig struct {
+	URL    string `yaml:"url"`
+	Weight int    `yaml:"weight"`
+}
+
+type Upstream struct {
+	URL      *url.URL
+	Weight   int
+	Director func(*http.Request)
+
+	active       int
+	current      int
+	healthy      bool
+	checks       int
+	failures     int
+	ejectedUntil time.Time
+	requests     int
+	failed       int
+	ejections    int
+}
+
+type Pool struct {
+	Config    Config
+	Upstreams []*Upstream
+	// Transport carries the health checks, so they reach the upstreams the
+	// same way proxied requests do. Nil means http.DefaultTransport.
+	Transport http.RoundTripper
+	next      int
+	mutex     sync.Mutex
+}
+
+func LoadConfig(path string) (Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Config{}, fmt.Errorf("failed to read upstreams file: %w", err)
+	}
+
+	var config Config
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return Config{}, fmt.Errorf("failed to parse upstreams file: %w", err)
+	}
+	return config, nil
+}
+
+// ParseURLs builds upstream configs from a comma-separated list of URLs.
+func ParseURLs(list string) []UpstreamConfig {
+	var upstreams []UpstreamConfig
+	for _, u := range strings.Split(list, ",") {
+		if u = strings.TrimSpace(u); u != "" {
+			upstreams = append(upstreams, UpstreamConfig{URL: u})
+		}
+	}
+	return upstreams
+}
+
+func NewPool(config Config, director func(*url.URL) func(*http.Request)) (*Pool, error) {
+	switch config.Strategy {
+	case "":
+		config.Strategy = StrategyRoundRobin
+	case StrategyRoundRobin, StrategyLeastConn, StrategyWeighted:
+	default:
+		return nil, fmt.Errorf("unknown balancing strategy %q", config.Strategy)
+	}
+	if len(config.Upstreams) == 0 {
+		return nil, fmt.Errorf("no upstreams")
+	}
+	if config.HealthCheck.Interval <= 0 {
+		config.HealthCheck.Interval = 5 * time.Second
+	}
+	if config.HealthCheck.Timeout <= 0 {
+		config.HealthCheck.Timeout = 1 * time.Second
+	}
+	if config.HealthCheck.HealthyThreshold <= 0 {
+		config.HealthCheck.HealthyThreshold = 1
+	}
+	if config.HealthCheck.UnhealthyThreshold <= 0 {
+		config.HealthCheck.UnhealthyThreshold = 1
+	}
+	if config.Outlier.EjectionTime <= 0 {
+		config.Outlier.EjectionTime = 30 * time.Second
+	}
+	if config.Outlier.MaxEjectionPercent <= 0 {
+		config.Outlier.MaxEjectionPercent = 50
+	}
+
+	p := &Pool{Config: config}
+	for _, uc := range config.Upstreams {
+		u, err := url.Parse(uc.URL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid upstream %q: %w", uc.URL, err)
+		}
+		weight := uc.Weight
+		if weight <= 0 {
+			weight = 1
+		}
+		p.Upstreams = append(p.Upstreams, &Upstream{
+			URL:      u,
+			Weight:   weight,
+			Director: director(u),
+			healthy:  true,
+		})
+	}
+	return p, nil
+}
+
+func (u *Upstream) available(now time.Time) bool {
+	return u.healthy && !now.Before(u.ejectedUntil)
+}
+
+// Acquire picks an upstream for a request. The caller must Release it once
+// the response is written.
+func (p *Pool) Acquire() (*Upstream, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	now := time.Now()
+	var candidates []*Upstream
+	for _, u := range p.Upstreams {
+		if u.available(now) {
+			candidates = append(candidates, u)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil, ErrNoUpstream
+	}
+
+	var chosen *Upstream
+	switch p.Config.Strategy {
+	case StrategyLeastConn:
+		for _, u := range candidates {
+			if chosen == nil || u.active*chosen.Weight < chosen.active*u.Weight {
+				chosen = u
+			}
+		}
+	case StrategyWeighted:
+		// Smooth weighted round robin, as in nginx.
+		total := 0
+		for _, u := range candidates {
+			u.current += u.Weight
+			total += u.Weight
+			if chosen == nil || u.current > chosen.current {
+				chosen = u
+			}
+		}
+		chosen.current -= total
+	default:
+		chosen = candidates[p.next%len(candidates)]
+		p.next++
+	}
+
+	chosen.active++
+	chosen.requests++
+	return chosen, nil
+}
+
+func (p *Pool) Release(u *Upstream) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	u.active--
+}
+
+// Report records the outcome of a request for passive outlier detection.
+func (p *Pool) Report(u *Upstream, success bool) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if success {
+		u.failures = 0
+		return
+	}
+
+	u.failed++
+	u.failures++
+	if p.Config.Outlier.ConsecutiveFailures <= 0 || u.failures < p.Config.Outlier.ConsecutiveFailures {
+		return
+	}
+
+	now := time.Now()
+	ejected := 0
+	for _, other := range p.Upstreams {
+		if now.Before(other.ejectedUntil) {
+			ejected++
+		}
+	}
+	if (ejected+1)*100 > p.Config.Outlier.MaxEjectionPercent*len(p.Upstreams) {
+		return
+	}
+
+	u.ejectedUntil = now.Add(p.Config.Outlier.EjectionTime)
+	u.failures = 0
+	u.ejections++
+}
+
+// HealthCheck probes every upstream until the context is done. onChange is
+// called whenever an upstream changes between healthy and unhealthy.
+func (p *Pool) HealthCheck(ctx context.Context, onChange func(u *Upstream, healthy bool, err error)) {
+	if p.Config.HealthCheck.Path == "" {
+		return
+	}
+
+	client := &http.Client{Transport: p.Transport, Timeout: p.Config.HealthCheck.Timeout}
+	ticker := time.NewTicker(p.Config.HealthCheck.Interval)
+	defer ticker.Stop()
+
+	for {
+		for _, u := range p.Upstreams {
+			err := p.probe(ctx, client, u)
+			if changed, healthy := p.recordCheck(u, err == nil); changed {
+				onChange(u, healthy, err)
+			}
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (p *Pool) probe(ctx context.Context, client *http.Client, u *Upstream) error {
+	target := u.URL.JoinPath(p.Config.HealthCheck.Path)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target.String(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return fmt.Errorf("health check returned %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func (p *Pool) recordCheck(u *Upstream, success bool) (bool, bool) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if success != u.healthy {
+		u.checks++
+	} else {
+		u.checks = 0
+	}
+
+	threshold := p.Config.HealthCheck.UnhealthyThreshold
+	if success {
+		threshold = p.Config.HealthCheck.HealthyThreshold
+	}
+	if u.checks < threshold {
+		return false, u.healthy
+	}
+
+	u.healthy = success
+	u.checks = 0
+	return true, u.healthy
+}
+
+func (p *Pool) Stats() map[string]interface{} {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	now := time.Now()
+	result := make(map[string]interface{}, len(p.Upstreams))
+	for _, u := range p.Upstreams {
+		result[u.URL.String()] = map[string]interface{}{
+			"Requests":  u.requests,
+			"Failed":    u.failed,
+			"Active":    u.active,
+			"Weight":    u.Weight,
+			"Healthy":   u.healthy,
+			"Ejected":   now.Before(u.ejectedUntil),
+			"Ejections": u.ejections,
+		}
+	}
+	return result
+}
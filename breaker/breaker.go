@@ -0,0 +1,262 @@
+package breaker
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	StateClosed   = "closed"
+	StateOpen     = "open"
+	StateHalfOpen = "half_open"
+)
+
+// What happens to requests while the circuit is open.
+const (
+	OnOpenFail = "fail"
+	OnOpenDLQ  = "dlq"
+)
+
+const buckets = 10
+
+// Config opens the circuit once at least MinRequests outcomes were recorded
+// within Window and the share of failures among them reaches FailureRatio.
+// After OpenFor the circuit lets HalfOpenRequests probes through and closes
+// when all of them succeed.
+type Config struct {
+	FailureRatio     float64       `yaml:"failure_ratio"`
+	Window           time.Duration `yaml:"window"`
+	MinRequests      int           `yaml:"min_requests"`
+	OpenFor          time.Duration `yaml:"open_for"`
+	HalfOpenRequests int           `yaml:"half_open_requests"`
+	OnOpen           string        `yaml:"on_open"`
+	DLQ              string        `yaml:"dlq"`
+}
+
+func (c *Config) setDefaults() error {
+	if c.FailureRatio <= 0 || c.FailureRatio > 1 {
+		return fmt.Errorf("failure ratio must be between 0 and 1")
+	}
+	switch {
+	case c.Window == 0:
+		c.Window = 10 * time.Second
+	case c.Window < buckets*time.Millisecond:
+		return fmt.Errorf("window must be at least %s", buckets*time.Millisecond)
+	}
+	if c.MinRequests <= 0 {
+		c.MinRequests = 10
+	}
+	if c.OpenFor <= 0 {
+		c.OpenFor = 5 * time.Second
+	}
+	if c.HalfOpenRequests <= 0 {
+		c.HalfOpenRequests = 1
+	}
+	switch c.OnOpen {
+	case "":
+		c.OnOpen = OnOpenFail
+	case OnOpenFail, OnOpenDLQ:
+	default:
+		return fmt.Errorf("unknown on_open action %q", c.OnOpen)
+	}
+	if c.DLQ == "" {
+		c.DLQ = "DLQ"
+	}
+	return nil
+}
+
+// OpenError is returned for requests rejected by an open circuit.
+type OpenError struct {
+	Name       string
+	RetryAfter time.Duration
+}
+
+func (e *OpenError) Error() string {
+	return fmt.Sprintf("circuit of %s is open", e.Name)
+}
+
+type bucket struct {
+	start    time.Time
+	requests int
+	failures int
+}
+
+type Breaker struct {
+	Name     string
+	Config   Config
+	onChange func(b *Breaker, from, to string)
+
+	state       string
+	openedAt    time.Time
+	probes      int
+	successes   int
+	window      [buckets]bucket
+	rejected    int
+	opened      int
+	transitions map[string]int
+	mutex       sync.Mutex
+}
+
+// New creates a closed breaker. onChange, when set, is called on every state
+// transition, outside of the breaker lock.
+func New(name string, config Config, onChange func(b *Breaker, from, to string)) (*Breaker, error) {
+	if err := config.setDefaults(); err != nil {
+		return nil, fmt.Errorf("invalid circuit breaker of %s: %w", name, err)
+	}
+	return &Breaker{
+		Name:        name,
+		Config:      config,
+		onChange:    onChange,
+		state:       StateClosed,
+		transitions: make(map[string]int),
+	}, nil
+}
+
+func (b *Breaker) bucket(now time.Time) *bucket {
+	width := b.Config.Window / buckets
+	start := now.Truncate(width)
+	bk := &b.window[start.UnixNano()/int64(width)%buckets]
+	if !bk.start.Equal(start) {
+		*bk = bucket{start: start}
+	}
+	return bk
+}
+
+func (b *Breaker) counts(now time.Time) (int, int) {
+	requests, failures := 0, 0
+	for _, bk := range b.window {
+		if now.Sub(bk.start) < b.Config.Window {
+			requests += bk.requests
+			failures += bk.failures
+		}
+	}
+	return requests, failures
+}
+
+// setState must be called with the lock held. It returns the transition to
+// report, if any.
+func (b *Breaker) setState(state string, now time.Time) func() {
+	from := b.state
+	if from == state {
+		return nil
+	}
+
+	b.state = state
+	b.transitions[from+"->"+state]++
+	switch state {
+	case StateOpen:
+		b.openedAt = now
+		b.opened++
+	case StateHalfOpen:
+		b.probes = 0
+		b.successes = 0
+	case StateClosed:
+		b.window = [buckets]bucket{}
+	}
+
+	if b.onChange == nil {
+		return nil
+	}
+	return func() { b.onChange(b, from, state) }
+}
+
+// Allow reports whether a request may be sent. In the half-open state only
+// the configured number of probes is let through.
+func (b *Breaker) Allow() error {
+	b.mutex.Lock()
+	now := time.Now()
+	var notify func()
+	if b.state == StateOpen && now.Sub(b.openedAt) >= b.Config.OpenFor {
+		notify = b.setState(StateHalfOpen, now)
+	}
+
+	var err error
+	switch b.state {
+	case StateOpen:
+		err = &OpenError{Name: b.Name, RetryAfter: b.Config.OpenFor - now.Sub(b.openedAt)}
+	case StateHalfOpen:
+		if b.probes >= b.Config.HalfOpenRequests {
+			err = &OpenError{Name: b.Name, RetryAfter: time.Second}
+		} else {
+			b.probes++
+		}
+	}
+	if err != nil {
+		b.rejected++
+	}
+	b.mutex.Unlock()
+
+	if notify != nil {
+		notify()
+	}
+	return err
+}
+
+// Open reports whether the circuit is open, without taking a probe.
+func (b *Breaker) Open() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return b.state == StateOpen && time.Since(b.openedAt) < b.Config.OpenFor
+}
+
+// Record feeds the outcome of a request into the breaker.
+func (b *Breaker) Record(success bool) {
+	b.mutex.Lock()
+	now := time.Now()
+	var notify func()
+
+	switch b.state {
+	case StateHalfOpen:
+		if !success {
+			notify = b.setState(StateOpen, now)
+			break
+		}
+		b.successes++
+		if b.successes >= b.Config.HalfOpenRequests {
+			notify = b.setState(StateClosed, now)
+		}
+	case StateClosed:
+		bk := b.bucket(now)
+		bk.requests++
+		if !success {
+			bk.failures++
+		}
+		requests, failures := b.counts(now)
+		if requests >= b.Config.MinRequests && float64(failures) >= b.Config.FailureRatio*float64(requests) {
+			notify = b.setState(StateOpen, now)
+		}
+	}
+	b.mutex.Unlock()
+
+	if notify != nil {
+		notify()
+	}
+}
+
+func (b *Breaker) State() string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return b.state
+}
+
+func (b *Breaker) Stats() map[string]interface{} {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	requests, failures := b.counts(time.Now())
+	transitions := make(map[string]int, len(b.transitions))
+	for transition, count := range b.transitions {
+		transitions[transition] = count
+	}
+	return map[string]interface{}{
+		"State":          b.state,
+		"WindowRequests": requests,
+		"WindowFailures": failures,
+		"Opened":         b.opened,
+		"Rejected":       b.rejected,
+		"Transitions":    transitions,
+	}
+}
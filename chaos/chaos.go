@@ -0,0 +1,325 @@
+package chaos
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"stress/routing"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	DistributionFixed       = "fixed"
+	DistributionUniform     = "uniform"
+	DistributionNormal      = "normal"
+	DistributionExponential = "exponential"
+)
+
+const (
+	ActionLatency   = "latency"
+	ActionDrop      = "drop"
+	ActionStatus    = "status"
+	ActionSlowDrip  = "slow_drip"
+	ActionTruncate  = "truncate"
+	ActionBandwidth = "bandwidth"
+)
+
+var ErrTruncated = errors.New("response truncated by chaos rule")
+
+// Match selects requests by LIKE patterns, as used by the routing tables.
+// Empty fields match everything.
+type Match struct {
+	Path     string            `yaml:"path"`
+	DataType string            `yaml:"data_type"`
+	Headers  map[string]string `yaml:"headers"`
+}
+
+type Latency struct {
+	Distribution string        `yaml:"distribution"`
+	Min          time.Duration `yaml:"min"`
+	Max          time.Duration `yaml:"max"`
+	Mean         time.Duration `yaml:"mean"`
+	StdDev       time.Duration `yaml:"stddev"`
+}
+
+type SlowDrip struct {
+	Chunk    int           `yaml:"chunk"`
+	Interval time.Duration `yaml:"interval"`
+}
+
+// Rule is one fault. It fires on a matching request with the given
+// probability, and every action set on it is applied: latency before the
+// request is forwarded; drop, status or the response shaping actions after.
+type Rule struct {
+	Name        string    `yaml:"name"`
+	Probability float64   `yaml:"probability"`
+	Match       Match     `yaml:"match"`
+	Latency     *Latency  `yaml:"latency"`
+	Drop        bool      `yaml:"drop"`
+	Status      int       `yaml:"status"`
+	RetryAfter  string    `yaml:"retry_after"`
+	SlowDrip    *SlowDrip `yaml:"slow_drip"`
+	Truncate    float64   `yaml:"truncate"`
+	Bandwidth   int       `yaml:"bandwidth"`
+}
+
+type Engine struct {
+	Rules []*Rule `yaml:"rules"`
+	stats map[string]map[string]int
+	mutex sync.Mutex
+}
+
+func Load(path string) (*Engine, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read chaos file: %w", err)
+	}
+
+	e := &Engine{stats: make(map[string]map[string]int)}
+	if err := yaml.Unmarshal(data, e); err != nil {
+		return nil, fmt.Errorf("failed to parse chaos file: %w", err)
+	}
+
+	for i, rule := range e.Rules {
+		if rule.Name == "" {
+			rule.Name = "rule-" + strconv.Itoa(i+1)
+		}
+		if rule.Probability < 0 || rule.Probability > 1 {
+			return nil, fmt.Errorf("chaos rule %s: probability must be between 0 and 1", rule.Name)
+		}
+		if rule.Truncate < 0 || rule.Truncate >= 1 {
+			return nil, fmt.Errorf("chaos rule %s: truncate must be a fraction below 1", rule.Name)
+		}
+		// net/http panics on codes outside 100-999, and 1xx ones are sent as
+		// informational responses, not as the status of the response.
+		if rule.Status != 0 && (rule.Status < 200 || rule.Status > 999) {
+			return nil, fmt.Errorf("chaos rule %s: status %d is not a final HTTP status", rule.Name, rule.Status)
+		}
+		if rule.Latency != nil {
+			switch rule.Latency.Distribution {
+			case "":
+				rule.Latency.Distribution = DistributionFixed
+			case DistributionFixed, DistributionUniform, DistributionNormal, DistributionExponential:
+			default:
+				return nil, fmt.Errorf("chaos rule %s: unknown latency distribution %q", rule.Name, rule.Latency.Distribution)
+			}
+		}
+		if rule.SlowDrip != nil && rule.SlowDrip.Chunk <= 0 {
+			rule.SlowDrip.Chunk = 1
+		}
+	}
+	return e, nil
+}
+
+func (m *Match) matches(r *http.Request) bool {
+	if m.Path != "" && !routing.Like(r.URL.Path, m.Path) {
+		return false
+	}
+	if m.DataType != "" && !routing.Like(r.Header.Get("x-esb-data-type"), m.DataType) {
+		return false
+	}
+	for header, pattern := range m.Headers {
+		if !routing.Like(r.Header.Get(header), pattern) {
+			return false
+		}
+	}
+	return true
+}
+
+// Sample draws a delay from the distribution, clamped to [Min, Max] when
+// those are set.
+func (l *Latency) Sample() time.Duration {
+	var d time.Duration
+	switch l.Distribution {
+	case DistributionUniform:
+		d = l.Min
+		if l.Max > l.Min {
+			d += time.Duration(rand.Int63n(int64(l.Max - l.Min)))
+		}
+	case DistributionNormal:
+		d = l.Mean + time.Duration(rand.NormFloat64()*float64(l.StdDev))
+	case DistributionExponential:
+		d = time.Duration(rand.ExpFloat64() * float64(l.Mean))
+	default:
+		d = l.Mean
+		if d == 0 {
+			d = l.Min
+		}
+	}
+
+	if d < l.Min {
+		d = l.Min
+	}
+	if l.Max > 0 && d > l.Max {
+		d = l.Max
+	}
+	return max(d, 0)
+}
+
+// Faults is the combined effect of the rules fired for one request.
+type Faults struct {
+	Rules      []string
+	Latency    time.Duration
+	Drop       bool
+	Status     int
+	RetryAfter string
+	SlowDrip   *SlowDrip
+	Truncate   float64
+	Bandwidth  int
+}
+
+func (f *Faults) Active() bool {
+	return len(f.Rules) > 0
+}
+
+// Roll decides which rules fire for the request.
+func (e *Engine) Roll(r *http.Request) *Faults {
+	f := &Faults{}
+	for _, rule := range e.Rules {
+		if !rule.Match.matches(r) || rand.Float64() >= rule.Probability {
+			continue
+		}
+
+		f.Rules = append(f.Rules, rule.Name)
+		var actions []string
+		if rule.Latency != nil {
+			f.Latency += rule.Latency.Sample()
+			actions = append(actions, ActionLatency)
+		}
+		if rule.Drop {
+			f.Drop = true
+			actions = append(actions, ActionDrop)
+		}
+		if rule.Status != 0 && f.Status == 0 {
+			f.Status = rule.Status
+			f.RetryAfter = rule.RetryAfter
+			actions = append(actions, ActionStatus)
+		}
+		if rule.SlowDrip != nil {
+			f.SlowDrip = rule.SlowDrip
+			actions = append(actions, ActionSlowDrip)
+		}
+		if rule.Truncate > 0 {
+			f.Truncate = rule.Truncate
+			actions = append(actions, ActionTruncate)
+		}
+		if rule.Bandwidth > 0 && (f.Bandwidth == 0 || rule.Bandwidth < f.Bandwidth) {
+			f.Bandwidth = rule.Bandwidth
+			actions = append(actions, ActionBandwidth)
+		}
+		e.record(rule.Name, actions)
+	}
+	return f
+}
+
+func (e *Engine) record(rule string, actions []string) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	stats, ok := e.stats[rule]
+	if !ok {
+		stats = make(map[string]int)
+		e.stats[rule] = stats
+	}
+	stats["fired"]++
+	for _, action := range actions {
+		stats[action]++
+	}
+}
+
+func (e *Engine) Stats() map[string]interface{} {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	result := make(map[string]interface{}, len(e.stats))
+	for rule, stats := range e.stats {
+		counts := make(map[string]int, len(stats))
+		for action, count := range stats {
+			counts[action] = count
+		}
+		result[rule] = counts
+	}
+	return result
+}
+
+// Writer shapes the response body: it writes in slow chunks, caps the
+// bandwidth and cuts the body short, failing the write so that the server
+// aborts the connection.
+type Writer struct {
+	http.ResponseWriter
+	faults  *Faults
+	limit   int64
+	written int64
+}
+
+func NewWriter(w http.ResponseWriter, faults *Faults) *Writer {
+	return &Writer{ResponseWriter: w, faults: faults, limit: -1}
+}
+
+func (w *Writer) WriteHeader(statusCode int) {
+	// Without a Content-Length (a chunked response) the fraction to keep is
+	// unknown, so the body is passed through whole.
+	if length, err := strconv.ParseInt(w.Header().Get("Content-Length"), 10, 64); w.faults.Truncate > 0 && err == nil {
+		w.limit = int64(math.Floor(float64(length) * w.faults.Truncate))
+	}
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *Writer) Write(p []byte) (int, error) {
+	truncated := false
+	if w.limit >= 0 && w.written+int64(len(p)) > w.limit {
+		p = p[:w.limit-w.written]
+		truncated = true
+	}
+
+	chunk := len(p)
+	if w.faults.SlowDrip != nil {
+		chunk = w.faults.SlowDrip.Chunk
+	}
+
+	n := 0
+	for n < len(p) {
+		end := min(n+chunk, len(p))
+		m, err := w.ResponseWriter.Write(p[n:end])
+		n += m
+		w.written += int64(m)
+		if err != nil {
+			return n, err
+		}
+		w.Flush()
+
+		var delay time.Duration
+		if w.faults.SlowDrip != nil {
+			delay = w.faults.SlowDrip.Interval
+		}
+		if w.faults.Bandwidth > 0 {
+			delay = max(delay, time.Duration(float64(m)/float64(w.faults.Bandwidth)*float64(time.Second)))
+		}
+		if delay > 0 {
+			time.Sleep(delay)
+		}
+	}
+
+	if truncated {
+		return n, ErrTruncated
+	}
+	return n, nil
+}
+
+func (w *Writer) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (w *Writer) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
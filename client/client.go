@@ -3,19 +3,30 @@ package main
 import (
 	"bytes"
 	"context"
+	"crypto/tls"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
+	"maps"
 	"math/rand"
 	"net/http"
+	"net/http/httptrace"
 	"os"
+	"slices"
 	"strconv"
 	. "stress/common"
+	"stress/ibsession"
+	"stress/inbox"
+	"stress/keys"
+	"stress/registry"
+	"stress/rules"
+	"stress/signing"
+	"stress/verify"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
-
-	"github.com/google/uuid"
 )
 
 type Config struct {
@@ -28,13 +39,96 @@ type Config struct {
 	MaxPayload            int
 	BrokenHeadersPercent  int
 	InvalidHeadersPercent int
+	Sign                  bool
+	TLS                   *tls.Config
+	Transport             string
+	MaxConnsPerHost       int
+	IdleTimeout           time.Duration
+	SharedTransport       bool
+	Timeouts              Timeouts
+	Retry                 RetryPolicy
+	Path                  string
+	InfoPath              string
+	User                  string
+	Password              string
+	Sessions              string
+	SessionPool           ibsession.Config
+	VerifyWait            time.Duration
+	Entities              int
+}
+
+// 1C session modes: each thread keeps its own session, or all threads share
+// one pool of sessions.
+const (
+	SessionsThread = "thread"
+	SessionsShared = "shared"
+)
+
+func (c *Config) url(path string) string {
+	scheme := "http"
+	if c.TLS != nil {
+		scheme = "https"
+	}
+	return fmt.Sprintf("%s://%s:%s%s", scheme, c.Host, c.Port, path)
+}
+
+// RetryPolicy resends a failed message up to Attempts more times with the
+// same headers, so the server sees the same x-esb-ver-id. Errors are matched
+// by class prefix, e.g. "timeout" matches every timeout_* class.
+type RetryPolicy struct {
+	Attempts   int
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	Statuses   []int
+	Errors     []string
+}
+
+func (p RetryPolicy) retryable(result attemptResult) bool {
+	if result.err != nil {
+		if result.class == "" {
+			return false
+		}
+		for _, class := range p.Errors {
+			if class != "" && strings.HasPrefix(result.class, class) {
+				return true
+			}
+		}
+		return false
+	}
+	return slices.Contains(p.Statuses, result.status)
+}
+
+// backoff doubles the delay with every attempt, capped at MaxBackoff, and
+// picks a random point in its upper half.
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	delay := p.Backoff << (attempt - 1)
+	if delay <= 0 || (p.MaxBackoff > 0 && delay > p.MaxBackoff) {
+		delay = p.MaxBackoff
+	}
+	if delay <= 0 {
+		return 0
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
 }
 
+const (
+	TransportHTTP1      = "http1"
+	TransportHTTP1Close = "http1-close"
+	TransportHTTP2      = "h2"
+	TransportH2C        = "h2c"
+)
+
 type Client struct {
-	Config  *Config
-	Headers *http.Header
-	Logger  *Logger
-	Stats   *Statistics
+	Config    *Config
+	Headers   *http.Header
+	Logger    *Logger
+	Stats     *Statistics
+	Registry  *registry.Registry
+	Rules     *rules.RuleSet
+	Sink      verify.Sink
+	Ledger    *verify.Ledger
+	transport *http.Transport
+	sessions  *ibsession.Pool
 }
 
 type Statistics struct {
@@ -44,12 +138,65 @@ type Statistics struct {
 	TotalDuration      time.Duration
 	MinDuration        time.Duration
 	MaxDuration        time.Duration
+	Rejections         map[string]int
+	SignedRequests     int
+	SigningDuration    time.Duration
+	TLSFailures        int
+	NewConnections     int
+	ReusedConnections  int
+	Protocols          map[string]int
+	Errors             map[string]int
+	DNS                Timing
+	Connect            Timing
+	TLS                Timing
+	TTFB               Timing
+	Messages           int
+	FirstAttemptOK     int
+	EventuallyOK       int
+	RetriedMessages    int
+	Retries            int
+	DuplicatesOnRetry  int
+	SessionErrors      int
+	Sessions           map[string]int
 	mutex              sync.Mutex
 }
 
+type Timing struct {
+	Count int
+	Total time.Duration
+	Max   time.Duration
+}
+
+func (t *Timing) Record(duration time.Duration) {
+	t.Count++
+	t.Total += duration
+	if duration > t.Max {
+		t.Max = duration
+	}
+}
+
+func (t Timing) Average() time.Duration {
+	if t.Count == 0 {
+		return 0
+	}
+	return time.Duration(int64(t.Total) / int64(t.Count))
+}
+
+func (t Timing) Summary() Fields {
+	return Fields{
+		"Count":   t.Count,
+		"Average": t.Average(),
+		"Max":     t.Max,
+	}
+}
+
 func NewStatistics() *Statistics {
 	return &Statistics{
 		MinDuration: time.Hour,
+		Rejections:  make(map[string]int),
+		Protocols:   make(map[string]int),
+		Errors:      make(map[string]int),
+		Sessions:    make(map[string]int),
 	}
 }
 
@@ -73,6 +220,108 @@ func (s *Statistics) RecordRequest(success bool, duration time.Duration) {
 	}
 }
 
+func (s *Statistics) RecordRejection(reason string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.Rejections[reason]++
+}
+
+func (s *Statistics) RecordError(class string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.Errors[class]++
+}
+
+func (s *Statistics) RecordRetry() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.Retries++
+}
+
+func (s *Statistics) RecordMessage(attempts int, delivered bool, duplicateOnRetry bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.Messages++
+	if attempts > 1 {
+		s.RetriedMessages++
+	}
+	if delivered {
+		s.EventuallyOK++
+		if attempts == 1 {
+			s.FirstAttemptOK++
+		}
+	}
+	if duplicateOnRetry {
+		s.DuplicatesOnRetry++
+	}
+}
+
+func (s *Statistics) RecordSessionError() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.SessionErrors++
+}
+
+// RecordSessionPool adds up the counters of a 1C session pool.
+func (s *Statistics) RecordSessionPool(stats map[string]interface{}) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for name, value := range stats {
+		if count, ok := value.(int); ok {
+			s.Sessions[name] += count
+		}
+	}
+}
+
+func (s *Statistics) RecordSigning(duration time.Duration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.SignedRequests++
+	s.SigningDuration += duration
+}
+
+func (s *Statistics) RecordHandshake(success bool, duration time.Duration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.TLS.Record(duration)
+	if !success {
+		s.TLSFailures++
+	}
+}
+
+func (s *Statistics) RecordTiming(timing *Timing, duration time.Duration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	timing.Record(duration)
+}
+
+func (s *Statistics) RecordConnection(reused bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if reused {
+		s.ReusedConnections++
+	} else {
+		s.NewConnections++
+	}
+}
+
+func (s *Statistics) RecordProtocol(proto string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.Protocols[proto]++
+}
+
 func (s *Statistics) GetSummary() Fields {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
@@ -87,6 +336,16 @@ func (s *Statistics) GetSummary() Fields {
 		avgDuration = time.Duration(int64(s.TotalDuration) / int64(s.TotalRequests))
 	}
 
+	avgSigning := time.Duration(0)
+	if s.SignedRequests > 0 {
+		avgSigning = time.Duration(int64(s.SigningDuration) / int64(s.SignedRequests))
+	}
+
+	reuseRatio := 0.0
+	if connections := s.NewConnections + s.ReusedConnections; connections > 0 {
+		reuseRatio = float64(s.ReusedConnections) / float64(connections) * 100
+	}
+
 	return Fields{
 		"TotalRequests":      s.TotalRequests,
 		"SuccessfulRequests": s.SuccessfulRequests,
@@ -95,7 +354,79 @@ func (s *Statistics) GetSummary() Fields {
 		"AverageDuration":    avgDuration,
 		"MinDuration":        s.MinDuration,
 		"MaxDuration":        s.MaxDuration,
+		"Rejections":         maps.Clone(s.Rejections),
+		"SignedRequests":     s.SignedRequests,
+		"AverageSigning":     avgSigning,
+		"TLSHandshakes":      s.TLS.Count,
+		"TLSFailures":        s.TLSFailures,
+		"AverageHandshake":   s.TLS.Average(),
+		"NewConnections":     s.NewConnections,
+		"ReusedConnections":  s.ReusedConnections,
+		"ReuseRatio":         fmt.Sprintf("%.2f%%", reuseRatio),
+		"Protocols":          maps.Clone(s.Protocols),
+		"Errors":             maps.Clone(s.Errors),
+		"Messages":           s.Messages,
+		"FirstAttemptOK":     s.FirstAttemptOK,
+		"EventuallyOK":       s.EventuallyOK,
+		"RetriedMessages":    s.RetriedMessages,
+		"Retries":            s.Retries,
+		"DuplicatesOnRetry":  s.DuplicatesOnRetry,
+		"SessionErrors":      s.SessionErrors,
+		"Sessions":           maps.Clone(s.Sessions),
+		"Timings": Fields{
+			"DNS":     s.DNS.Summary(),
+			"Connect": s.Connect.Summary(),
+			"TLS":     s.TLS.Summary(),
+			"TTFB":    s.TTFB.Summary(),
+		},
+	}
+}
+
+func rejectionReason(resp *http.Response, body []byte) (string, *Problem) {
+	problem, ok := ParseProblem(resp.Header.Get("Content-Type"), body)
+	if !ok {
+		return fmt.Sprintf("http_%d", resp.StatusCode), nil
 	}
+	if problem.Header != "" {
+		return problem.Code + " (" + problem.Header + ")", problem
+	}
+	return problem.Code, problem
+}
+
+func (c *Config) NewTransport() (*http.Transport, error) {
+	transport := &http.Transport{
+		TLSClientConfig: c.TLS,
+		MaxConnsPerHost: c.MaxConnsPerHost,
+		IdleConnTimeout: c.IdleTimeout,
+	}
+	if c.MaxConnsPerHost > 0 {
+		transport.MaxIdleConnsPerHost = c.MaxConnsPerHost
+	}
+	c.Timeouts.Apply(transport)
+
+	protocols := new(http.Protocols)
+	switch c.Transport {
+	case TransportHTTP1:
+		protocols.SetHTTP1(true)
+	case TransportHTTP1Close:
+		protocols.SetHTTP1(true)
+		transport.DisableKeepAlives = true
+	case TransportHTTP2:
+		if c.TLS == nil {
+			return nil, fmt.Errorf("transport %s requires TLS", c.Transport)
+		}
+		protocols.SetHTTP2(true)
+	case TransportH2C:
+		if c.TLS != nil {
+			return nil, fmt.Errorf("transport %s cannot be used with TLS", c.Transport)
+		}
+		protocols.SetUnencryptedHTTP2(true)
+	default:
+		return nil, fmt.Errorf("unknown transport %q", c.Transport)
+	}
+	transport.Protocols = protocols
+
+	return transport, nil
 }
 
 func NewClient(config *Config, headers *http.Header) (*Client, error) {
@@ -104,47 +435,73 @@ func NewClient(config *Config, headers *http.Header) (*Client, error) {
 		return nil, fmt.Errorf("failed to create logger: %w", err)
 	}
 
+	transport, err := config.NewTransport()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create transport: %w", err)
+	}
+
 	return &Client{
-		Config:  config,
-		Headers: headers,
-		Logger:  logger,
-		Stats:   NewStatistics(),
+		Config:    config,
+		Headers:   headers,
+		Logger:    logger,
+		Stats:     NewStatistics(),
+		Rules:     rules.Default(),
+		transport: transport,
 	}, nil
 }
 
-func getRandomHeaders(baseHeaders *http.Header, threadID int, brokenHeadersPercent int, invalidHeadersPercent int) http.Header {
+func getRandomHeaders(baseHeaders *http.Header, reg *registry.Registry, ruleSet *rules.RuleSet, threadID int, brokenHeadersPercent int, invalidHeadersPercent int) (http.Header, []string) {
 	headers := http.Header{}
+	var invalidHeaders []string
+
+	generated := map[string]string{
+		"x-esb-src":       "sys:erp", //fmt.Sprint(threadID)
+		"x-esb-data-type": DataTypes[rand.Intn(len(DataTypes))],
+		"x-esb-key":       EsbKeys[rand.Intn(len(EsbKeys))],
+	}
+	registered := map[string]string{}
+	if reg != nil {
+		// Only systems with a key are picked: the default keys belong to
+		// sys:erp and would not authenticate any other source.
+		if system, ok := reg.RandomSender(); ok {
+			registered["x-esb-src"] = system.SystemID
+			registered["x-esb-key"] = system.Addr
+		}
+		if dt, ok := reg.RandomDataType(); ok {
+			registered["x-esb-data-type"] = dt.DataType
+		}
+	}
 
-	for _, header := range RequiredHeaders {
+	for _, rule := range ruleSet.Rules {
 		if rand.Intn(100) < brokenHeadersPercent {
 			continue
 		}
 
-		value := ""
-		switch header {
-		case "x-esb-src":
-			value = "sys:erp" //fmt.Sprint(threadID)
-		case "x-esb-data-type":
-			value = DataTypes[rand.Intn(len(DataTypes))]
-		case "x-esb-ver-id":
-			value = uuid.New().String()
-		case "x-esb-key":
-			value = EsbKeys[rand.Intn(len(EsbKeys))]
-		case "x-esb-ver-no":
-			t := time.Now()
-			value = t.Format("20060102T150405")
-		default:
-			value = baseHeaders.Get(header)
+		name := strings.ToLower(rule.Header)
+		fallback, ok := generated[name]
+		if !ok {
+			fallback = baseHeaders.Get(name)
 		}
+		value := rule.Generate(fallback)
+		if v, ok := registered[name]; ok {
+			value = v
+		}
+		headers.Set(name, value)
 
 		if rand.Intn(100) < invalidHeadersPercent {
-			value = "invalid-value"
+			if !rule.AllowDuplicates && rand.Intn(2) == 0 {
+				headers.Add(name, value)
+			} else {
+				headers.Set(name, rule.GenerateInvalid())
+			}
 		}
 
-		headers.Set(header, value)
+		if rule.Violates(headers.Values(name)) {
+			invalidHeaders = append(invalidHeaders, name)
+		}
 	}
 
-	return headers
+	return headers, invalidHeaders
 }
 
 var letters = [62]byte{'a', 'b', 'c', 'd', 'e', 'f', 'g', 'h', 'i', 'j', 'k', 'l', 'm', 'n', 'o', 'p', 'q', 'r', 's', 't', 'u', 'v', 'w', 'x', 'y', 'z',
@@ -159,7 +516,18 @@ func randomPayload(size int) string {
 	return string(payload)
 }
 
-func (c *Client) SendMessage(ctx context.Context, httpClient *http.Client, threadID int, messageNumber int, randomHeaders http.Header) (time.Duration, int, error) {
+type attemptResult struct {
+	duration  time.Duration
+	status    int
+	problem   *Problem
+	duplicate bool
+	class     string
+	err       error
+	// sessionExpired is set when 1C rejected the session of the request.
+	sessionExpired bool
+}
+
+func (c *Client) SendMessage(ctx context.Context, httpClient *http.Client, sessions *ibsession.Pool, threadID int, messageNumber int, randomHeaders http.Header, invalidHeaders []string) (time.Duration, int, error) {
 	messageID := strconv.Itoa(threadID) + "-" + strconv.Itoa(messageNumber)
 	size := rand.Intn(c.Config.MaxPayload-c.Config.MinPayload+1) + c.Config.MinPayload
 	message := &Message{
@@ -173,76 +541,295 @@ func (c *Client) SendMessage(ctx context.Context, httpClient *http.Client, threa
 		return 0, 0, fmt.Errorf("error marshaling message: %w", err)
 	}
 
-	url := fmt.Sprintf("http://%s:%s/msg", c.Config.Host, c.Config.Port)
-	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(payload))
-	if err != nil {
-		return 0, 0, fmt.Errorf("error creating request: %w", err)
-	}
-
-	req.Header = randomHeaders
+	// Every attempt below sends these headers, so retries keep the
+	// x-esb-ver-id of the first one.
+	headers := c.messageHeaders(randomHeaders, invalidHeaders)
 
-	if len(randomHeaders) < len(RequiredHeaders) {
+	if len(headers) < len(c.Rules.Rules) {
 		c.Logger.Warn().
 			Int("thread_id", threadID).
 			Str("message_id", messageID).
 			Msg("Missing headers in request")
 	}
 
-	for header, value := range randomHeaders {
-		if value[0] == "invalid-value" {
-			c.Logger.Warn().
-				Int("thread_id", threadID).
-				Str("message_id", messageID).
-				Str("header", header).
-				Msg("Invalid header value in request")
-		}
+	for _, header := range invalidHeaders {
+		c.Logger.Warn().
+			Int("thread_id", threadID).
+			Str("message_id", messageID).
+			Str("header", header).
+			Msg("Invalid header value in request")
 	}
 
 	c.Logger.Info().
 		Int("thread_id", threadID).
 		Str("message_id", messageID).
 		Int("payload_size", size).
-		Interface("selectedHeaders", randomHeaders).
+		Interface("selectedHeaders", keys.Redact(headers)).
 		Msg("Sending message")
 
-	startTime := time.Now()
+	var result attemptResult
+	attempt := 1
+	for ; ; attempt++ {
+		result = c.attempt(ctx, httpClient, sessions, threadID, messageID, attempt, payload, headers)
+		if result.sessionExpired {
+			// Resend at once in a new session; this is not a retry.
+			result = c.attempt(ctx, httpClient, sessions, threadID, messageID, attempt, payload, headers)
+		}
+		if attempt > c.Config.Retry.Attempts || !c.Config.Retry.retryable(result) {
+			break
+		}
+
+		delay := c.Config.Retry.backoff(attempt)
+		c.Stats.RecordRetry()
+		c.Logger.Warn().
+			Int("thread_id", threadID).
+			Str("message_id", messageID).
+			Str("ver_id", headers.Get("x-esb-ver-id")).
+			Int("attempt", attempt).
+			Int("status", result.status).
+			Str("error_class", result.class).
+			Dur("backoff", delay).
+			Msg("Retrying message")
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			c.Stats.RecordMessage(attempt, false, false)
+			c.recordSent(headers, message, false)
+			return result.duration, result.status, ctx.Err()
+		}
+	}
+
+	// A retry the server reports as a duplicate only says that an earlier
+	// attempt got in; it may still be in flight and fail. Such messages are
+	// counted apart and not as delivered, the verification tells whether
+	// they arrived.
+	delivered := result.err == nil && result.status == http.StatusOK && !result.duplicate
+	c.Stats.RecordMessage(attempt, delivered, attempt > 1 && result.duplicate)
+	c.recordSent(headers, message, delivered)
+
+	return result.duration, result.status, result.err
+}
+
+// recordSent notes the message for the verification after the run.
+func (c *Client) recordSent(headers http.Header, message *Message, accepted bool) {
+	if c.Ledger == nil {
+		return
+	}
+	c.Ledger.Record(verify.Sent{
+		VerID:       headers.Get("x-esb-ver-id"),
+		MessageID:   message.ID,
+		PayloadHash: inbox.PayloadHash(message.Payload),
+		SentAt:      message.Timestamp,
+		Accepted:    accepted,
+	})
+}
+
+// messageHeaders returns the thread headers with fresh values for the rules
+// that identify a single message, such as x-esb-ver-id and x-esb-ver-no, and
+// the entity it is a version of. Headers generated invalid on purpose are kept
+// as they are.
+func (c *Client) messageHeaders(randomHeaders http.Header, invalidHeaders []string) http.Header {
+	headers := randomHeaders.Clone()
+	for _, rule := range c.Rules.Rules {
+		name := strings.ToLower(rule.Header)
+		if rule.Type != rules.TypeUUID && rule.Type != rules.TypeTimestamp {
+			continue
+		}
+		if len(headers.Values(name)) != 1 || slices.Contains(invalidHeaders, name) {
+			continue
+		}
+		headers.Set(name, rule.Generate(""))
+	}
+	if c.Config.Entities > 0 {
+		headers.Set("x-esb-ids", fmt.Sprintf("entity-%d", rand.Intn(c.Config.Entities)))
+	}
+	return headers
+}
+
+func (c *Client) attempt(ctx context.Context, httpClient *http.Client, sessions *ibsession.Pool, threadID int, messageID string, attempt int, payload []byte, headers http.Header) attemptResult {
+	url := c.Config.url(c.Config.Path)
+
+	var dnsStart, connectStart, handshakeStart, startTime time.Time
+	var phase atomic.Value
+	phase.Store(PhaseRequest)
+	// Only the message request is traced: sessions are started with the
+	// plain context, before startTime is set.
+	traced := httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) {
+			phase.Store(PhaseDNS)
+			dnsStart = time.Now()
+		},
+		DNSDone: func(httptrace.DNSDoneInfo) {
+			c.Stats.RecordTiming(&c.Stats.DNS, time.Since(dnsStart))
+		},
+		ConnectStart: func(_, _ string) {
+			phase.Store(PhaseConnect)
+			connectStart = time.Now()
+		},
+		ConnectDone: func(_, _ string, err error) {
+			if err == nil {
+				c.Stats.RecordTiming(&c.Stats.Connect, time.Since(connectStart))
+			}
+		},
+		TLSHandshakeStart: func() {
+			phase.Store(PhaseTLS)
+			handshakeStart = time.Now()
+		},
+		TLSHandshakeDone: func(_ tls.ConnectionState, err error) {
+			c.Stats.RecordHandshake(err == nil, time.Since(handshakeStart))
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			phase.Store(PhaseRequest)
+			c.Stats.RecordConnection(info.Reused)
+		},
+		WroteRequest: func(httptrace.WroteRequestInfo) {
+			phase.Store(PhaseResponseHeader)
+		},
+		GotFirstResponseByte: func() {
+			phase.Store(PhaseBody)
+			c.Stats.RecordTiming(&c.Stats.TTFB, time.Since(startTime))
+		},
+	})
+
+	req, err := http.NewRequestWithContext(traced, "POST", url, bytes.NewBuffer(payload))
+	if err != nil {
+		return attemptResult{err: fmt.Errorf("error creating request: %w", err)}
+	}
+
+	req.Header = headers.Clone()
+
+	if secret := headers.Get("x-esb-key"); c.Config.Sign && secret != "" {
+		req.Header.Del("x-esb-key")
+
+		signStart := time.Now()
+		if err := signing.Sign(req, payload, secret, signStart); err != nil {
+			return attemptResult{err: fmt.Errorf("error signing request: %w", err)}
+		}
+		c.Stats.RecordSigning(time.Since(signStart))
+	}
+
+	if c.Config.User != "" {
+		req.SetBasicAuth(c.Config.User, c.Config.Password)
+	}
+
+	var session *ibsession.Session
+	if sessions != nil {
+		session, err = sessions.Get(ctx)
+		if err != nil {
+			class := ClassifyError(err, "")
+			c.Stats.RecordError(class)
+			return attemptResult{class: class, err: fmt.Errorf("%s: %w", class, err)}
+		}
+		req.AddCookie(&http.Cookie{Name: ibsession.CookieName, Value: session.ID})
+	}
+
+	startTime = time.Now()
 	resp, err := httpClient.Do(req)
 	duration := time.Since(startTime)
 	if err != nil {
+		if session != nil {
+			sessions.Put(session)
+		}
+		class := ClassifyError(err, phase.Load().(string))
 		c.Stats.RecordRequest(false, duration)
-		return duration, 0, err
+		c.Stats.RecordError(class)
+		return attemptResult{duration: duration, class: class, err: fmt.Errorf("%s: %w", class, err)}
 	}
 
 	defer resp.Body.Close()
 
+	c.Stats.RecordProtocol(resp.Proto)
+	b, err := io.ReadAll(resp.Body)
+	sessionExpired := err == nil && resp.StatusCode != http.StatusOK && session != nil && sessions.Invalid(b)
+	if sessionExpired {
+		sessions.Discard(session)
+		c.Stats.RecordSessionError()
+		c.Logger.Warn().
+			Int("thread_id", threadID).
+			Str("message_id", messageID).
+			Int("status", resp.StatusCode).
+			Msg("1C session expired")
+	} else if session != nil {
+		sessions.Put(session)
+	}
+	if err != nil {
+		class := ClassifyError(err, PhaseBody)
+		c.Stats.RecordRequest(false, duration)
+		c.Stats.RecordError(class)
+		return attemptResult{duration: duration, status: resp.StatusCode, class: class, err: fmt.Errorf("%s: error reading response body: %w", class, err)}
+	}
+
+	result := attemptResult{
+		duration:       duration,
+		status:         resp.StatusCode,
+		duplicate:      resp.Header.Get(DuplicateHeader) != "",
+		sessionExpired: sessionExpired,
+	}
+
 	success := resp.StatusCode == 200
 	c.Stats.RecordRequest(success, duration)
-	b, err := io.ReadAll(resp.Body)
+
+	if !success {
+		var reason string
+		reason, result.problem = rejectionReason(resp, b)
+		c.Stats.RecordRejection(reason)
+		if result.problem != nil {
+			result.duplicate = result.problem.Code == CodeDuplicateMessage
+			c.Logger.Warn().
+				Int("thread_id", threadID).
+				Str("message_id", messageID).
+				Int("attempt", attempt).
+				Int("status", resp.StatusCode).
+				Str("code", result.problem.Code).
+				Str("header", result.problem.Header).
+				Str("correlation_id", result.problem.CorrelationID).
+				Msg(result.problem.Detail)
+		}
+	}
 
 	c.Logger.Info().
 		Int("thread_id", threadID).
 		Str("message_id", messageID).
+		Int("attempt", attempt).
 		Dur("duration", duration).
 		Int("status", resp.StatusCode).
 		Msg(string(b))
 
-	return duration, resp.StatusCode, nil
+	return result
 }
 
 func (c *Client) RunThread(ctx context.Context, threadID int, wg *sync.WaitGroup) {
 	defer wg.Done()
 
+	transport := c.transport
+	if !c.Config.SharedTransport {
+		transport = transport.Clone()
+	}
 	httpClient := &http.Client{
-		Timeout:   1 * time.Second,
-		Transport: &http.Transport{},
+		Timeout:   c.Config.Timeouts.Total,
+		Transport: transport,
+	}
+	if !c.Config.SharedTransport {
+		defer httpClient.CloseIdleConnections()
+	}
+
+	sessions := c.sessions
+	if c.Config.Sessions == SessionsThread {
+		config := c.Config.SessionPool
+		config.Size = 1
+		sessions = c.newSessionPool(httpClient, config)
+		defer func() {
+			sessions.Close()
+			c.Stats.RecordSessionPool(sessions.Stats())
+		}()
 	}
-	defer httpClient.CloseIdleConnections()
 
 	c.Logger.Info().
 		Int("thread_id", threadID).
 		Msg("Starting thread")
 
-	randomHeaders := getRandomHeaders(c.Headers, threadID, c.Config.BrokenHeadersPercent, c.Config.InvalidHeadersPercent)
+	randomHeaders, invalidHeaders := getRandomHeaders(c.Headers, c.Registry, c.Rules, threadID, c.Config.BrokenHeadersPercent, c.Config.InvalidHeadersPercent)
 
 	for i := 1; i <= c.Config.MessagesCount; i++ {
 		select {
@@ -252,7 +839,7 @@ func (c *Client) RunThread(ctx context.Context, threadID int, wg *sync.WaitGroup
 				Msg("Thread interrupted")
 			return
 		default:
-			_, _, err := c.SendMessage(ctx, httpClient, threadID, i, randomHeaders)
+			_, _, err := c.SendMessage(ctx, httpClient, sessions, threadID, i, randomHeaders, invalidHeaders)
 			if err != nil {
 				c.Logger.Error().
 					Int("thread_id", threadID).
@@ -267,10 +854,22 @@ func (c *Client) RunThread(ctx context.Context, threadID int, wg *sync.WaitGroup
 		Msg("Thread completed")
 }
 
+func (c *Client) newSessionPool(httpClient *http.Client, config ibsession.Config) *ibsession.Pool {
+	pool := ibsession.NewPool(c.Config.url(c.Config.InfoPath), c.Config.User, c.Config.Password, config, httpClient)
+	if err := pool.Prewarm(context.Background()); err != nil {
+		c.Logger.Error().Err(err).Msg("Error prewarming 1C sessions")
+	}
+	return pool
+}
+
 func (c *Client) Run() {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
+	if c.Config.Sessions == SessionsShared {
+		c.sessions = c.newSessionPool(&http.Client{Timeout: c.Config.Timeouts.Total, Transport: c.transport}, c.Config.SessionPool)
+	}
+
 	c.Logger.Info().
 		Int("threads", c.Config.Threads).
 		Int("messages_per_thread", c.Config.MessagesCount).
@@ -286,6 +885,11 @@ func (c *Client) Run() {
 	}
 
 	wg.Wait()
+	if c.sessions != nil {
+		c.sessions.Close()
+		c.Stats.RecordSessionPool(c.sessions.Stats())
+	}
+	c.transport.CloseIdleConnections()
 
 	duration := time.Since(startTime)
 	totalMessages := c.Config.Threads * c.Config.MessagesCount
@@ -310,13 +914,109 @@ func (c *Client) Run() {
 	fmt.Printf("Average Response:    %v\n", stats["AverageDuration"])
 	fmt.Printf("Minimum Response:    %v\n", stats["MinDuration"])
 	fmt.Printf("Maximum Response:    %v\n", stats["MaxDuration"])
+	if c.Config.Sign {
+		fmt.Printf("Signed Requests:     %d\n", stats["SignedRequests"])
+		fmt.Printf("Average Signing:     %v\n", stats["AverageSigning"])
+	}
+	if c.Config.Retry.Attempts > 0 {
+		fmt.Printf("Messages:            %d\n", stats["Messages"])
+		fmt.Printf("First Attempt OK:    %d\n", stats["FirstAttemptOK"])
+		fmt.Printf("Eventually OK:       %d\n", stats["EventuallyOK"])
+		fmt.Printf("Retried Messages:    %d (%d retries)\n", stats["RetriedMessages"], stats["Retries"])
+		fmt.Printf("Duplicates On Retry: %d\n", stats["DuplicatesOnRetry"])
+	}
+	if c.Config.Sessions != "" {
+		sessions := stats["Sessions"].(map[string]int)
+		fmt.Printf("1C Sessions:         %d created (%d failed), %d reused, %d expired, %d closed\n",
+			sessions["Created"], sessions["CreateFailed"], sessions["Reused"], sessions["Expired"], sessions["Closed"])
+		fmt.Printf("Session Errors:      %d\n", stats["SessionErrors"])
+	}
+	fmt.Printf("Transport:           %s\n", c.Config.Transport)
+	fmt.Printf("Connections:         %d new, %d reused (%s reuse)\n", stats["NewConnections"], stats["ReusedConnections"], stats["ReuseRatio"])
+	if protocols := stats["Protocols"].(map[string]int); len(protocols) > 0 {
+		fmt.Printf("Protocols:          ")
+		for _, proto := range slices.Sorted(maps.Keys(protocols)) {
+			fmt.Printf(" %s=%d", proto, protocols[proto])
+		}
+		fmt.Printf("\n")
+	}
+	if c.Config.TLS != nil {
+		fmt.Printf("TLS Handshakes:      %d (%d failed)\n", stats["TLSHandshakes"], stats["TLSFailures"])
+		fmt.Printf("Average Handshake:   %v\n", stats["AverageHandshake"])
+	}
+	if errs := stats["Errors"].(map[string]int); len(errs) > 0 {
+		fmt.Printf("Error Breakdown:\n")
+		for _, class := range slices.Sorted(maps.Keys(errs)) {
+			fmt.Printf("  %-40s %d\n", class, errs[class])
+		}
+	}
+	timings := stats["Timings"].(Fields)
+	for _, phase := range []string{"DNS", "Connect", "TLS", "TTFB"} {
+		timing := timings[phase].(Fields)
+		if timing["Count"].(int) > 0 {
+			fmt.Printf("%-8s avg/max:     %v / %v (%d)\n", phase, timing["Average"], timing["Max"], timing["Count"])
+		}
+	}
+	if rejections := stats["Rejections"].(map[string]int); len(rejections) > 0 {
+		fmt.Printf("Rejection Reasons:\n")
+		for _, reason := range slices.Sorted(maps.Keys(rejections)) {
+			fmt.Printf("  %-40s %d\n", reason, rejections[reason])
+		}
+	}
 	fmt.Printf("-------------------------\n")
 
+	if c.Sink != nil {
+		c.Verify()
+	}
+
 	if err := c.Logger.Close(); err != nil {
 		fmt.Fprintf(os.Stderr, "Error closing log file: %v\n", err)
 	}
 }
 
+// Verify reconciles the messages sent with those that arrived at the sink.
+func (c *Client) Verify() {
+	report, err := verify.Verify(context.Background(), c.Sink, c.Ledger, c.Config.VerifyWait, time.Second)
+	if err != nil {
+		c.Logger.Error().Err(err).Msg("Error verifying delivery")
+		fmt.Fprintf(os.Stderr, "Error verifying delivery: %v\n", err)
+		return
+	}
+
+	for _, sent := range report.Lost {
+		c.Logger.Warn().
+			Str("message_id", sent.MessageID).
+			Str("ver_id", sent.VerID).
+			Msg("Message lost")
+	}
+	for _, sent := range report.Corrupted {
+		c.Logger.Warn().
+			Str("message_id", sent.MessageID).
+			Str("ver_id", sent.VerID).
+			Msg("Message corrupted")
+	}
+	c.Logger.Info().
+		Fields(report.Fields()).
+		Msg("Delivery Verification")
+
+	fmt.Printf("\n--- Delivery Verification ---\n")
+	fmt.Printf("Sent:                %d (%d accepted)\n", report.Sent, report.Accepted)
+	if report.Untracked > 0 {
+		fmt.Printf("Without x-esb-ver-id: %d (not verified)\n", report.Untracked)
+	}
+	fmt.Printf("Received:            %d\n", report.Received)
+	fmt.Printf("Lost:                %d\n", len(report.Lost))
+	fmt.Printf("Duplicated:          %d\n", report.Duplicated)
+	fmt.Printf("Reordered:           %d\n", report.Reordered)
+	fmt.Printf("Corrupted:           %d\n", len(report.Corrupted))
+	fmt.Printf("Unconfirmed:         %d\n", report.Unconfirmed)
+	if latency := report.Latency; latency.Count > 0 {
+		fmt.Printf("End-to-End avg/max:  %v / %v\n", latency.Average, latency.Max)
+		fmt.Printf("End-to-End p50/p95/p99: %v / %v / %v\n", latency.P50, latency.P95, latency.P99)
+	}
+	fmt.Printf("-----------------------------\n")
+}
+
 func main() {
 	host := flag.String("host", os.Getenv("SERVICE_HOST"), "Service host")
 	port := flag.String("port", os.Getenv("SERVICE_PORT"), "Service port")
@@ -327,6 +1027,40 @@ func main() {
 	logFile := flag.String("log", "client.json", "Path to log file")
 	brokenHeadersPercent := flag.Int("broken-headers-percent", getEnvInt("BROKEN_HEADERS_PERCENT", 10), "Percentage of requests with missing headers")
 	invalidHeadersPercent := flag.Int("invalid-headers-percent", getEnvInt("INVALID_HEADERS_PERCENT", 10), "Percentage of requests with invalid header values")
+	registryFile := flag.String("registry", os.Getenv("REGISTRY"), "Path to YAML registry of systems and data types")
+	rulesFile := flag.String("rules", os.Getenv("RULES"), "Path to YAML header validation rules")
+	useTLS := flag.Bool("tls", getEnvBool("TLS", false), "Connect over HTTPS")
+	tlsCA := flag.String("ca", os.Getenv("TLS_CA"), "Path to CA of the server certificate")
+	tlsCert := flag.String("cert", os.Getenv("TLS_CERT"), "Path to client certificate for mutual TLS")
+	tlsKey := flag.String("key", os.Getenv("TLS_KEY"), "Path to private key of the client certificate")
+	insecure := flag.Bool("insecure", getEnvBool("TLS_INSECURE", false), "Skip verification of the server certificate")
+	transportMode := flag.String("transport", getEnvString("TRANSPORT", TransportHTTP1), "Transport: http1 (keep-alive), http1-close (connection per request), h2 (HTTP/2 over TLS) or h2c")
+	maxConnsPerHost := flag.Int("max-conns-per-host", getEnvInt("MAX_CONNS_PER_HOST", 0), "Maximum connections per host, 0 for unlimited")
+	idleTimeout := flag.Duration("idle-timeout", 90*time.Second, "How long an idle connection is kept open")
+	timeout := flag.Duration("timeout", getEnvDuration("TIMEOUT", 1*time.Second), "Total request timeout, including reading the response")
+	connectTimeout := flag.Duration("connect-timeout", getEnvDuration("CONNECT_TIMEOUT", 0), "TCP connect timeout, 0 for none")
+	tlsTimeout := flag.Duration("tls-timeout", getEnvDuration("TLS_TIMEOUT", 0), "TLS handshake timeout, 0 for none")
+	responseHeaderTimeout := flag.Duration("response-header-timeout", getEnvDuration("RESPONSE_HEADER_TIMEOUT", 0), "Timeout waiting for response headers after the request is written, 0 for none")
+	retries := flag.Int("retries", getEnvInt("RETRIES", 0), "Number of times a failed message is resent with the same x-esb-ver-id")
+	retryBackoff := flag.Duration("retry-backoff", getEnvDuration("RETRY_BACKOFF", 100*time.Millisecond), "Delay before the first retry, doubled for each further retry")
+	retryMaxBackoff := flag.Duration("retry-max-backoff", getEnvDuration("RETRY_MAX_BACKOFF", 2*time.Second), "Maximum delay between retries")
+	retryStatuses := flag.String("retry-statuses", getEnvString("RETRY_STATUSES", "429,500,502,503,504"), "Comma-separated response statuses that are retried")
+	retryErrors := flag.String("retry-errors", getEnvString("RETRY_ERRORS", "connection_refused,connection_reset,timeout"), "Comma-separated error classes (prefixes) that are retried")
+	sharedTransport := flag.Bool("shared-transport", getEnvBool("SHARED_TRANSPORT", false), "Share one connection pool between all threads")
+	sign := flag.Bool("sign", getEnvBool("SIGN_REQUESTS", false), "Sign requests with HMAC of their x-esb-key instead of sending the key")
+	path := flag.String("path", getEnvString("SERVICE_PATH", "/msg"), "Path messages are posted to, e.g. /base/hs/esb/msg for a 1C publication")
+	infoPath := flag.String("info-path", getEnvString("SERVICE_INFO_PATH", "/info/"), "Path used to start and finish 1C sessions")
+	user := flag.String("user", os.Getenv("SERVICE_USER"), "User for basic authentication")
+	password := flag.String("password", os.Getenv("SERVICE_PASSWORD"), "Password for basic authentication")
+	sessionsMode := flag.String("sessions", os.Getenv("SESSIONS"), "1C sessions: thread (one per thread) or shared (pool shared by all threads), empty for none")
+	sessionPoolSize := flag.Int("session-pool-size", getEnvInt("SESSION_POOL_SIZE", 0), "Maximum number of 1C sessions in the shared pool, defaults to the number of threads")
+	sessionPrewarm := flag.Int("session-prewarm", getEnvInt("SESSION_PREWARM", 0), "Number of 1C sessions opened before sending")
+	sessionMaxAge := flag.Duration("session-max-age", getEnvDuration("SESSION_MAX_AGE", 0), "Maximum age of a 1C session, 0 for no limit")
+	sessionIdleTimeout := flag.Duration("session-idle-timeout", getEnvDuration("SESSION_IDLE_TIMEOUT", 0), "How long a 1C session may stay unused, 0 for no limit")
+	sessionPatterns := flag.String("session-patterns", os.Getenv("SESSION_PATTERNS"), "Comma-separated response fragments that mark a 1C session as invalid")
+	verifySink := flag.String("verify", os.Getenv("VERIFY"), "Sink checked for delivered messages after the run: dumper URL, PostgreSQL DSN or dumper log file")
+	entities := flag.Int("entities", getEnvInt("ENTITIES", 0), "Number of entities messages are spread over in x-esb-ids, so that the server orders their versions; 0 to omit the header")
+	verifyWait := flag.Duration("verify-wait", getEnvDuration("VERIFY_WAIT", 10*time.Second), "How long to wait for accepted messages to reach the sink")
 
 	flag.Parse()
 
@@ -349,6 +1083,72 @@ func main() {
 		MaxPayload:            *maxPayload,
 		BrokenHeadersPercent:  *brokenHeadersPercent,
 		InvalidHeadersPercent: *invalidHeadersPercent,
+		Sign:                  *sign,
+		Transport:             *transportMode,
+		MaxConnsPerHost:       *maxConnsPerHost,
+		IdleTimeout:           *idleTimeout,
+		SharedTransport:       *sharedTransport,
+		Path:                  *path,
+		InfoPath:              *infoPath,
+		User:                  *user,
+		Password:              *password,
+		Sessions:              *sessionsMode,
+		VerifyWait:            *verifyWait,
+		Entities:              *entities,
+		SessionPool: ibsession.Config{
+			Size:        *sessionPoolSize,
+			Prewarm:     *sessionPrewarm,
+			MaxAge:      *sessionMaxAge,
+			IdleTimeout: *sessionIdleTimeout,
+		},
+		Timeouts: Timeouts{
+			Connect:        *connectTimeout,
+			TLSHandshake:   *tlsTimeout,
+			ResponseHeader: *responseHeaderTimeout,
+			Total:          *timeout,
+		},
+		Retry: RetryPolicy{
+			Attempts:   *retries,
+			Backoff:    *retryBackoff,
+			MaxBackoff: *retryMaxBackoff,
+			Errors:     strings.Split(*retryErrors, ","),
+		},
+	}
+
+	switch config.Sessions {
+	case "", SessionsThread, SessionsShared:
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown sessions mode: %s\n", config.Sessions)
+		os.Exit(1)
+	}
+	if config.SessionPool.Size <= 0 {
+		config.SessionPool.Size = config.Threads
+	}
+	for _, pattern := range strings.Split(*sessionPatterns, ",") {
+		if pattern = strings.TrimSpace(pattern); pattern != "" {
+			config.SessionPool.InvalidPatterns = append(config.SessionPool.InvalidPatterns, pattern)
+		}
+	}
+
+	for _, status := range strings.Split(*retryStatuses, ",") {
+		if strings.TrimSpace(status) == "" {
+			continue
+		}
+		code, err := strconv.Atoi(strings.TrimSpace(status))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid retry status %q\n", status)
+			os.Exit(1)
+		}
+		config.Retry.Statuses = append(config.Retry.Statuses, code)
+	}
+
+	if *useTLS || *tlsCA != "" || *tlsCert != "" || *insecure {
+		tlsConfig, err := NewClientTLSConfig(*tlsCA, *tlsCert, *tlsKey, *insecure)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error loading TLS configuration: %v\n", err)
+			os.Exit(1)
+		}
+		config.TLS = tlsConfig
 	}
 
 	client, err := NewClient(config, &headers)
@@ -357,6 +1157,35 @@ func main() {
 		os.Exit(1)
 	}
 
+	if *rulesFile != "" {
+		client.Rules, err = rules.Load(*rulesFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error loading header rules: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if *registryFile != "" {
+		client.Registry, err = registry.LoadFile(*registryFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error loading registry: %v\n", err)
+			os.Exit(1)
+		}
+		if len(client.Registry.Senders()) == 0 {
+			fmt.Fprintf(os.Stderr, "Registry has no active system with an addr key to send as\n")
+			os.Exit(1)
+		}
+	}
+
+	if *verifySink != "" {
+		client.Sink, err = verify.Open(*verifySink)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error opening verification sink: %v\n", err)
+			os.Exit(1)
+		}
+		client.Ledger = verify.NewLedger()
+	}
+
 	client.Run()
 }
 
@@ -368,3 +1197,28 @@ func getEnvInt(key string, defaultValue int) int {
 	}
 	return defaultValue
 }
+
+func getEnvBool(key string, defaultValue bool) bool {
+	if value, exists := os.LookupEnv(key); exists {
+		if boolValue, err := strconv.ParseBool(value); err == nil {
+			return boolValue
+		}
+	}
+	return defaultValue
+}
+
+func getEnvString(key string, defaultValue string) string {
+	if value, exists := os.LookupEnv(key); exists && value != "" {
+		return value
+	}
+	return defaultValue
+}
+
+func getEnvDuration(key string, defaultValue time.Duration) time.Duration {
+	if value, exists := os.LookupEnv(key); exists {
+		if durationValue, err := time.ParseDuration(value); err == nil {
+			return durationValue
+		}
+	}
+	return defaultValue
+}
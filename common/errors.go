@@ -0,0 +1,120 @@
+package common
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Timeouts of an outgoing request. Total bounds the whole exchange including
+// reading the body, the others bound a single phase. Zero means no limit.
+type Timeouts struct {
+	Connect        time.Duration `yaml:"connect"`
+	TLSHandshake   time.Duration `yaml:"tls_handshake"`
+	ResponseHeader time.Duration `yaml:"response_header"`
+	Total          time.Duration `yaml:"total"`
+}
+
+func (t Timeouts) Apply(transport *http.Transport) {
+	dialer := &net.Dialer{Timeout: t.Connect, KeepAlive: 30 * time.Second}
+	transport.DialContext = dialer.DialContext
+	transport.TLSHandshakeTimeout = t.TLSHandshake
+	transport.ResponseHeaderTimeout = t.ResponseHeader
+}
+
+// Request phases, as reported by httptrace.
+const (
+	PhaseDNS            = "dns"
+	PhaseConnect        = "connect"
+	PhaseTLS            = "tls"
+	PhaseRequest        = "request"
+	PhaseResponseHeader = "response_header"
+	PhaseBody           = "body"
+)
+
+const (
+	ErrorDNS               = "dns_error"
+	ErrorConnectionRefused = "connection_refused"
+	ErrorConnectionReset   = "connection_reset"
+	ErrorTLS               = "tls_error"
+	ErrorProtocol          = "protocol_error"
+	ErrorCanceled          = "canceled"
+	ErrorOther             = "other"
+)
+
+// ClassifyError names the cause of a failed request. Timeouts are reported
+// per phase, e.g. timeout_connect. The phase is the one the request was in
+// when it failed; when empty it is guessed from the error.
+func ClassifyError(err error, phase string) string {
+	var dnsErr *net.DNSError
+	var opErr *net.OpError
+	var netErr net.Error
+	var recordErr tls.RecordHeaderError
+	var alertErr tls.AlertError
+	var certErr *tls.CertificateVerificationError
+	var unknownAuthErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+
+	switch {
+	case err == nil:
+		return ""
+	case errors.As(err, &dnsErr):
+		if dnsErr.IsTimeout {
+			return "timeout_" + PhaseDNS
+		}
+		return ErrorDNS
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return ErrorConnectionRefused
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.EPIPE), errors.Is(err, syscall.ECONNABORTED):
+		return ErrorConnectionReset
+	case errors.Is(err, context.Canceled):
+		return ErrorCanceled
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout_" + timeoutPhase(err, phase)
+	case errors.As(err, &recordErr), errors.As(err, &alertErr), errors.As(err, &certErr),
+		errors.As(err, &unknownAuthErr), errors.As(err, &hostnameErr):
+		return ErrorTLS
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return ErrorConnectionReset
+	case errors.As(err, &opErr) && opErr.Op == "dial":
+		return ErrorConnectionRefused
+	case isProtocolError(err):
+		return ErrorProtocol
+	}
+	return ErrorOther
+}
+
+func timeoutPhase(err error, phase string) string {
+	message := err.Error()
+	switch {
+	case strings.Contains(message, "TLS handshake timeout"):
+		return PhaseTLS
+	case strings.Contains(message, "timeout awaiting response headers"):
+		return PhaseResponseHeader
+	case phase != "":
+		return phase
+	}
+
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return PhaseConnect
+	}
+	return "total"
+}
+
+func isProtocolError(err error) bool {
+	message := err.Error()
+	for _, marker := range []string{"malformed HTTP", "http2:", "bad status", "unexpected EOF reading trailer", "server sent GOAWAY", "net/http: HTTP/1.x transport connection broken"} {
+		if strings.Contains(message, marker) {
+			return true
+		}
+	}
+	return false
+}
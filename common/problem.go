@@ -0,0 +1,81 @@
+package common
+
+import (
+	"encoding/json"
+	"mime"
+	"net/http"
+)
+
+const (
+	CorrelationHeader  = "x-correlation-id"
+	DuplicateHeader    = "x-esb-duplicate"
+	ProblemContentType = "application/problem+json"
+)
+
+const (
+	CodeNotAuthenticated    = "not_authenticated"
+	CodeCertificateMismatch = "certificate_source_mismatch"
+	CodeSchemaViolation     = "schema_violation"
+	CodeDuplicateMessage    = "duplicate_message"
+	CodeStaleVersion        = "stale_version"
+	CodeBodyReadError       = "body_read_error"
+	CodeStorageError        = "storage_error"
+	CodeDeliveryError       = "delivery_error"
+	CodeCircuitOpen         = "circuit_open"
+)
+
+// Problem is an RFC 7807 error body extended with the ESB error code, the
+// offending header and the correlation ID of the request.
+type Problem struct {
+	Type          string      `json:"type"`
+	Title         string      `json:"title"`
+	Status        int         `json:"status"`
+	Detail        string      `json:"detail,omitempty"`
+	Instance      string      `json:"instance,omitempty"`
+	Code          string      `json:"code"`
+	Header        string      `json:"header,omitempty"`
+	CorrelationID string      `json:"correlation_id,omitempty"`
+	Errors        interface{} `json:"errors,omitempty"`
+}
+
+func NewProblem(status int, code string, detail string) *Problem {
+	return &Problem{
+		Type:   "urn:esb:error:" + code,
+		Title:  http.StatusText(status),
+		Status: status,
+		Detail: detail,
+		Code:   code,
+	}
+}
+
+func (p *Problem) WithHeader(header string) *Problem {
+	p.Header = header
+	return p
+}
+
+func (p *Problem) WithErrors(errs interface{}) *Problem {
+	p.Errors = errs
+	return p
+}
+
+// Write sends the problem, taking the correlation ID from the response
+// headers set earlier by the handler.
+func (p *Problem) Write(w http.ResponseWriter) {
+	p.CorrelationID = w.Header().Get(CorrelationHeader)
+	w.Header().Set("Content-Type", ProblemContentType)
+	w.WriteHeader(p.Status)
+	json.NewEncoder(w).Encode(p)
+}
+
+func ParseProblem(contentType string, body []byte) (*Problem, bool) {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	if mediaType != ProblemContentType && mediaType != "application/json" {
+		return nil, false
+	}
+
+	p := &Problem{}
+	if err := json.Unmarshal(body, p); err != nil || p.Code == "" {
+		return nil, false
+	}
+	return p, true
+}
@@ -0,0 +1,250 @@
+package dedup
+
+import (
+	"bufio"
+	"container/list"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type entry struct {
+	key  string
+	seen time.Time
+}
+
+// Cache is an LRU of recently accepted keys. Entries older than the TTL are
+// treated as absent, and the least recently seen entry is evicted once the
+// capacity is reached.
+type Cache struct {
+	capacity   int
+	ttl        time.Duration
+	items      map[string]*list.Element
+	order      *list.List
+	path       string
+	file       *os.File
+	writer     *bufio.Writer
+	lines      int
+	err        error
+	mutex      sync.Mutex
+	duplicates int
+	evicted    int
+}
+
+func NewCache(capacity int, ttl time.Duration, persistPath string) (*Cache, error) {
+	c := &Cache{
+		capacity: capacity,
+		ttl:      ttl,
+		items:    make(map[string]*list.Element),
+		order:    list.New(),
+	}
+
+	if persistPath != "" {
+		if err := c.load(persistPath); err != nil {
+			return nil, err
+		}
+	}
+
+	return c, nil
+}
+
+// Add records the key and reports whether it was already present.
+func (c *Cache) Add(key string) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	now := time.Now()
+	if el, ok := c.items[key]; ok {
+		e := el.Value.(*entry)
+		if c.ttl <= 0 || now.Sub(e.seen) < c.ttl {
+			c.duplicates++
+			c.order.MoveToFront(el)
+			return true
+		}
+		c.remove(el)
+	}
+
+	c.insert(key, now)
+	c.append(now.UnixNano(), key)
+	return false
+}
+
+// AddIfRoom is Add for keys that must not be forgotten before they expire.
+// Keys are kept in the order they were added, so once the capacity is reached
+// the expired ones are dropped from the oldest; if that frees no room, the key
+// is not recorded and full is reported.
+func (c *Cache) AddIfRoom(key string) (duplicate, full bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	now := time.Now()
+	expired := func(el *list.Element) bool {
+		return c.ttl > 0 && now.Sub(el.Value.(*entry).seen) >= c.ttl
+	}
+	if el, ok := c.items[key]; ok {
+		if !expired(el) {
+			c.duplicates++
+			return true, false
+		}
+		c.remove(el)
+	}
+	if c.capacity > 0 && c.order.Len() >= c.capacity {
+		for el := c.order.Back(); el != nil && expired(el); el = c.order.Back() {
+			c.remove(el)
+		}
+		if c.order.Len() >= c.capacity {
+			return false, true
+		}
+	}
+
+	c.insert(key, now)
+	c.append(now.UnixNano(), key)
+	return false, false
+}
+
+// Forget removes the key, so that a message whose processing failed may be
+// submitted again.
+func (c *Cache) Forget(key string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if el, ok := c.items[key]; ok {
+		c.remove(el)
+		c.append(-1, key)
+	}
+}
+
+func (c *Cache) Stats() map[string]interface{} {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return map[string]interface{}{
+		"Entries":    len(c.items),
+		"Duplicates": c.duplicates,
+		"Evicted":    c.evicted,
+	}
+}
+
+// Close rewrites the persistence file with the live entries.
+func (c *Cache) Close() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.file == nil {
+		return nil
+	}
+	if err := c.rewrite(); err != nil && c.err == nil {
+		c.err = err
+	}
+	if err := c.file.Close(); err != nil && c.err == nil {
+		c.err = fmt.Errorf("failed to close dedup file: %w", err)
+	}
+	c.file = nil
+	return c.err
+}
+
+// compactAfter is the least number of lines the persistence file may hold
+// before it is rewritten. Above it, the file is rewritten once it holds twice
+// as many lines as there are live entries.
+const compactAfter = 1024
+
+func (c *Cache) append(nanos int64, key string) {
+	if c.file == nil {
+		return
+	}
+	fmt.Fprintf(c.writer, "%d %s\n", nanos, key)
+	c.lines++
+	if c.lines > max(compactAfter, 2*c.order.Len()) {
+		if err := c.rewrite(); err != nil && c.err == nil {
+			c.err = err
+		}
+	}
+}
+
+// rewrite replaces the persistence file with the unexpired entries, oldest
+// first, and appends to the new file from then on.
+func (c *Cache) rewrite() error {
+	now := time.Now()
+	file, err := os.Create(c.path + ".tmp")
+	if err != nil {
+		return fmt.Errorf("failed to rewrite dedup file: %w", err)
+	}
+	writer := bufio.NewWriter(file)
+	lines := 0
+	for el := c.order.Back(); el != nil; el = el.Prev() {
+		e := el.Value.(*entry)
+		if c.ttl > 0 && now.Sub(e.seen) >= c.ttl {
+			continue
+		}
+		fmt.Fprintf(writer, "%d %s\n", e.seen.UnixNano(), e.key)
+		lines++
+	}
+	if err := writer.Flush(); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to rewrite dedup file: %w", err)
+	}
+	if err := os.Rename(file.Name(), c.path); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to rewrite dedup file: %w", err)
+	}
+
+	if c.file != nil {
+		c.file.Close()
+	}
+	c.file, c.writer, c.lines = file, writer, lines
+	return nil
+}
+
+func (c *Cache) insert(key string, seen time.Time) {
+	c.items[key] = c.order.PushFront(&entry{key: key, seen: seen})
+
+	for c.capacity > 0 && c.order.Len() > c.capacity {
+		c.remove(c.order.Back())
+		c.evicted++
+	}
+}
+
+func (c *Cache) remove(el *list.Element) {
+	c.order.Remove(el)
+	delete(c.items, el.Value.(*entry).key)
+}
+
+// load restores unexpired entries from the persistence file and rewrites it
+// with only those entries before appending new ones. Appends are buffered
+// until the file is rewritten or closed.
+func (c *Cache) load(path string) error {
+	if data, err := os.Open(path); err == nil {
+		now := time.Now()
+		scanner := bufio.NewScanner(data)
+		for scanner.Scan() {
+			ts, key, ok := strings.Cut(scanner.Text(), " ")
+			if !ok {
+				continue
+			}
+			nanos, err := strconv.ParseInt(ts, 10, 64)
+			if err != nil {
+				continue
+			}
+			if el, ok := c.items[key]; ok {
+				c.remove(el)
+			}
+			seen := time.Unix(0, nanos)
+			if nanos < 0 || (c.ttl > 0 && now.Sub(seen) >= c.ttl) {
+				continue
+			}
+			c.insert(key, seen)
+		}
+		data.Close()
+		if err := scanner.Err(); err != nil {
+			return fmt.Errorf("failed to read dedup file: %w", err)
+		}
+	} else if !os.IsNotExist(err) {
+		return fmt.Errorf("failed to open dedup file: %w", err)
+	}
+
+	c.path = path
+	return c.rewrite()
+}
@@ -0,0 +1,192 @@
+package dedup
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newCache(t *testing.T, capacity int, ttl time.Duration, path string) *Cache {
+	t.Helper()
+	c, err := NewCache(capacity, ttl, path)
+	if err != nil {
+		t.Fatalf("NewCache: %v", err)
+	}
+	return c
+}
+
+func countLines(t *testing.T, path string) int {
+	t.Helper()
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("opening %s: %v", path, err)
+	}
+	defer file.Close()
+
+	lines := 0
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		lines++
+	}
+	return lines
+}
+
+func TestAdd(t *testing.T) {
+	c := newCache(t, 0, 0, "")
+	if c.Add("a") {
+		t.Error("first Add(a) reported a duplicate")
+	}
+	if !c.Add("a") {
+		t.Error("second Add(a) did not report a duplicate")
+	}
+	if c.Add("b") {
+		t.Error("first Add(b) reported a duplicate")
+	}
+	if stats := c.Stats(); stats["Entries"] != 2 || stats["Duplicates"] != 1 {
+		t.Errorf("Stats() = %v", stats)
+	}
+}
+
+func TestTTL(t *testing.T) {
+	c := newCache(t, 0, 20*time.Millisecond, "")
+	c.Add("a")
+	if !c.Add("a") {
+		t.Error("Add(a) within the TTL did not report a duplicate")
+	}
+	time.Sleep(30 * time.Millisecond)
+	if c.Add("a") {
+		t.Error("Add(a) after the TTL reported a duplicate")
+	}
+}
+
+func TestEviction(t *testing.T) {
+	c := newCache(t, 2, 0, "")
+	c.Add("a")
+	c.Add("b")
+	// Seeing a again makes b the least recently seen entry.
+	c.Add("a")
+	c.Add("c")
+
+	if !c.Add("a") {
+		t.Error("recently seen a was evicted")
+	}
+	if c.Add("b") {
+		t.Error("least recently seen b was not evicted")
+	}
+	if stats := c.Stats(); stats["Evicted"] != 2 {
+		t.Errorf("Stats() = %v, want 2 evicted", stats)
+	}
+}
+
+func TestForget(t *testing.T) {
+	c := newCache(t, 0, 0, "")
+	c.Add("a")
+	c.Forget("a")
+	if c.Add("a") {
+		t.Error("Add(a) after Forget(a) reported a duplicate")
+	}
+	c.Forget("missing")
+}
+
+func TestReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dedup")
+	c := newCache(t, 0, time.Hour, path)
+	c.Add("a")
+	c.Add("b")
+	c.Add("c")
+	c.Forget("b")
+	if err := c.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if lines := countLines(t, path); lines != 2 {
+		t.Errorf("file has %d lines after Close, want the 2 live entries", lines)
+	}
+
+	c = newCache(t, 0, time.Hour, path)
+	defer c.Close()
+	for key, want := range map[string]bool{"a": true, "b": false, "c": true} {
+		if got := c.Add(key); got != want {
+			t.Errorf("Add(%s) after reload = %v, want %v", key, got, want)
+		}
+	}
+}
+
+func TestReloadExpired(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dedup")
+	c := newCache(t, 0, 20*time.Millisecond, path)
+	c.Add("a")
+	if err := c.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	time.Sleep(30 * time.Millisecond)
+
+	c = newCache(t, 0, 20*time.Millisecond, path)
+	defer c.Close()
+	if c.Add("a") {
+		t.Error("expired entry was restored")
+	}
+}
+
+func TestCompaction(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dedup")
+	c := newCache(t, 10, 0, path)
+	for i := range 10 * compactAfter {
+		c.Add(fmt.Sprint(i))
+	}
+	if err := c.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if lines := countLines(t, path); lines != 10 {
+		t.Errorf("file has %d lines, want the 10 live entries", lines)
+	}
+
+	c = newCache(t, 10, 0, path)
+	defer c.Close()
+	if !c.Add(fmt.Sprint(10*compactAfter - 1)) {
+		t.Error("newest entry was not restored")
+	}
+}
+
+func TestCompactionBoundsFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dedup")
+	c := newCache(t, 10, 0, path)
+	defer c.Close()
+	for i := range 10 * compactAfter {
+		c.Add(fmt.Sprint(i))
+	}
+	c.mutex.Lock()
+	c.writer.Flush()
+	c.mutex.Unlock()
+	if lines := countLines(t, path); lines > compactAfter+10 {
+		t.Errorf("file grew to %d lines", lines)
+	}
+}
+
+func TestAddIfRoom(t *testing.T) {
+	c := newCache(t, 2, 20*time.Millisecond, "")
+	for _, key := range []string{"a", "b"} {
+		if duplicate, full := c.AddIfRoom(key); duplicate || full {
+			t.Errorf("AddIfRoom(%s) = %v, %v", key, duplicate, full)
+		}
+	}
+	if duplicate, full := c.AddIfRoom("a"); !duplicate || full {
+		t.Errorf("AddIfRoom(a) again = %v, %v, want a duplicate", duplicate, full)
+	}
+	if duplicate, full := c.AddIfRoom("c"); duplicate || !full {
+		t.Errorf("AddIfRoom(c) = %v, %v, want full", duplicate, full)
+	}
+	if !c.Add("a") || !c.Add("b") {
+		t.Error("a full cache evicted a key")
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	if duplicate, full := c.AddIfRoom("c"); duplicate || full {
+		t.Errorf("AddIfRoom(c) after expiry = %v, %v", duplicate, full)
+	}
+	if stats := c.Stats(); stats["Entries"] != 1 || stats["Evicted"] != 0 {
+		t.Errorf("Stats() = %v", stats)
+	}
+}
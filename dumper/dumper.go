@@ -1,39 +1,131 @@
 package main
 
 import (
+	"bytes"
 	"flag"
+	"io"
 	"net/http"
 	. "stress/common"
+	"stress/inbox"
+	"stress/keys"
+	"stress/mock"
+	"time"
 )
 
 type Dumper struct {
-	Proxy  *http.Client
-	Logger *Logger
+	Proxy   *http.Client
+	Logger  *Logger
+	Service *mock.Service
+	Inbox   *inbox.Inbox
 }
 
-func NewDumper(logFile *string) *Dumper {
+func NewDumper(logFile *string, service *mock.Service, messages *inbox.Inbox) *Dumper {
 	logger, _ := NewLogger(*logFile)
 	ph := Dumper{
-		Logger: logger,
+		Logger:  logger,
+		Service: service,
+		Inbox:   messages,
 	}
 	return &ph
 }
 
 func (h *Dumper) DumpRequest(w http.ResponseWriter, r *http.Request) {
-	h.Logger.Info().Interface("headers", r.Header).Msg("request received")
-	w.WriteHeader(http.StatusOK)
+	startTime := time.Now()
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		h.Logger.Error().Err(err).Msg("Error reading request body")
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+
+	outcome, status := h.Service.HandleMsg(w, r)
+	var receipt *inbox.Receipt
+	if status >= 200 && status < 300 {
+		receipt = inbox.NewReceipt(r.Header, body, startTime)
+		h.Inbox.Add(receipt)
+	}
+
+	h.Logger.Info().
+		Interface("headers", keys.Redact(r.Header)).
+		Str("outcome", outcome).
+		Int("status", status).
+		Interface("receipt", receipt).
+		Dur("duration", time.Since(startTime)).
+		Msg("request received")
+}
+
+func (h *Dumper) HandleInfo(w http.ResponseWriter, r *http.Request) {
+	h.Logger.Info().Str("ibsession", r.Header.Get("IBSession")).Msg("session request received")
+	h.Service.HandleInfo(w, r)
+}
+
+func (h *Dumper) logStats(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		h.Logger.Info().
+			Interface("Statistics", h.Service.Stats()).
+			Msg("Mock statistics")
+		h.Logger.Info().
+			Interface("Statistics", h.Inbox.Counts()).
+			Msg("Inbox statistics")
+	}
 }
 
 func main() {
 	logFile := flag.String("log", "proxy.json", "Path to log file")
+	addr := flag.String("addr", "", "Listen address, localhost:80 or localhost:443 with TLS by default")
+	prefix := flag.String("prefix", "", "Path prefix of the service, e.g. /base/hs/esb")
+	mockFile := flag.String("mock", "", "Path to YAML behavior of the mock 1C service")
+	retain := flag.Int("retain", 100000, "Number of received messages kept in memory, 0 for all")
+	spillFile := flag.String("spill", "", "Path to file receiving the messages evicted from memory")
+	tlsCert := flag.String("tls-cert", "", "Path to TLS certificate, enables HTTPS")
+	tlsKey := flag.String("tls-key", "", "Path to TLS private key")
+	tlsClientCA := flag.String("tls-client-ca", "", "Path to CA of client certificates, enables mutual TLS")
 
 	flag.Parse()
 
-	dumper := NewDumper(logFile)
+	var config mock.Config
+	if *mockFile != "" {
+		var err error
+		config, err = mock.Load(*mockFile)
+		if err != nil {
+			panic(err)
+		}
+	}
 
-	http.HandleFunc("/msg", dumper.DumpRequest)
+	messages, err := inbox.New(*retain, *spillFile)
+	if err != nil {
+		panic(err)
+	}
+	defer messages.Close()
+
+	dumper := NewDumper(logFile, mock.NewService(config), messages)
+	go dumper.logStats(5 * time.Second)
 
-	err := http.ListenAndServe("localhost:80", nil)
+	http.HandleFunc(*prefix+"/msg", dumper.DumpRequest)
+	http.HandleFunc(*prefix+"/info", dumper.HandleInfo)
+	http.HandleFunc(*prefix+"/info/", dumper.HandleInfo)
+	http.Handle("/api/", messages.Handler())
+
+	if *tlsCert != "" {
+		tlsConfig, tlsErr := NewServerTLSConfig(*tlsCert, *tlsKey, *tlsClientCA)
+		if tlsErr != nil {
+			panic(tlsErr)
+		}
+		if *addr == "" {
+			*addr = "localhost:443"
+		}
+		server := &http.Server{Addr: *addr, TLSConfig: tlsConfig}
+		err = server.ListenAndServeTLS("", "")
+	} else {
+		if *addr == "" {
+			*addr = "localhost:80"
+		}
+		err = http.ListenAndServe(*addr, nil)
+	}
 	if err != nil {
 		panic(err)
 	}
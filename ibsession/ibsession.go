@@ -0,0 +1,336 @@
+package ibsession
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CookieName is the cookie 1C uses to carry the session ID.
+const CookieName = "ibsession"
+
+// DefaultInvalidPatterns are the response fragments 1C returns for a session
+// that expired or was dropped on its side.
+var DefaultInvalidPatterns = []string{"Ошибка работы сеанса", "Session error"}
+
+var ErrNoSession = errors.New("no ibsession cookie in response")
+
+// Config of a session pool. At most Size sessions are open at a time and
+// Prewarm of them are opened up front. A session is closed once it is older
+// than MaxAge or has been idle longer than IdleTimeout.
+type Config struct {
+	Size            int           `yaml:"size"`
+	Prewarm         int           `yaml:"prewarm"`
+	MaxAge          time.Duration `yaml:"max_age"`
+	IdleTimeout     time.Duration `yaml:"idle_timeout"`
+	InvalidPatterns []string      `yaml:"invalid_patterns"`
+}
+
+type Session struct {
+	ID       string
+	created  time.Time
+	lastUsed time.Time
+}
+
+type poolStats struct {
+	created       int
+	failed        int
+	reused        int
+	expired       int
+	invalidated   int
+	closed        int
+	closeFailed   int
+	waits         int
+	totalCreation time.Duration
+}
+
+// Pool hands out 1C sessions of one infobase. A session is used by one
+// request at a time and returned with Put, or with Discard when 1C rejected
+// it.
+type Pool struct {
+	Config   Config
+	infoURL  string
+	user     string
+	password string
+	client   *http.Client
+	slots    chan struct{}
+	idle     []*Session
+	started  time.Time
+	stats    poolStats
+	closed   bool
+	mutex    sync.Mutex
+}
+
+func NewPool(infoURL, user, password string, config Config, client *http.Client) *Pool {
+	if config.Size <= 0 {
+		config.Size = 1
+	}
+	config.Prewarm = min(config.Prewarm, config.Size)
+	if len(config.InvalidPatterns) == 0 {
+		config.InvalidPatterns = DefaultInvalidPatterns
+	}
+
+	return &Pool{
+		Config:   config,
+		infoURL:  infoURL,
+		user:     user,
+		password: password,
+		client:   client,
+		slots:    make(chan struct{}, config.Size),
+		started:  time.Now(),
+	}
+}
+
+func (p *Pool) request(ctx context.Context, action string, id string) (*http.Response, error) {
+	r, err := http.NewRequestWithContext(ctx, http.MethodGet, p.infoURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	r.Header.Set("IBSession", action)
+	if p.user != "" && p.password != "" {
+		r.SetBasicAuth(p.user, p.password)
+	}
+	if id != "" {
+		r.AddCookie(&http.Cookie{Name: CookieName, Value: id})
+	}
+	return p.client.Do(r)
+}
+
+func (p *Pool) open(ctx context.Context) (*Session, error) {
+	startTime := time.Now()
+	resp, err := p.request(ctx, "start", "")
+	if err == nil {
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			err = fmt.Errorf("session start returned %d", resp.StatusCode)
+		}
+	}
+
+	var session *Session
+	if err == nil {
+		err = ErrNoSession
+		for _, cookie := range resp.Cookies() {
+			if cookie.Name == CookieName && cookie.Value != "" {
+				now := time.Now()
+				session = &Session{ID: cookie.Value, created: now, lastUsed: now}
+				err = nil
+				break
+			}
+		}
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if err != nil {
+		p.stats.failed++
+		return nil, fmt.Errorf("failed to open 1C session: %w", err)
+	}
+	p.stats.created++
+	p.stats.totalCreation += time.Since(startTime)
+	return session, nil
+}
+
+// close ends the session on the 1C side.
+func (p *Pool) close(session *Session) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	resp, err := p.request(ctx, "finish", session.ID)
+	if err == nil {
+		resp.Body.Close()
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if err != nil {
+		p.stats.closeFailed++
+		return
+	}
+	p.stats.closed++
+}
+
+func (p *Pool) expired(session *Session, now time.Time) bool {
+	return (p.Config.MaxAge > 0 && now.Sub(session.created) >= p.Config.MaxAge) ||
+		(p.Config.IdleTimeout > 0 && now.Sub(session.lastUsed) >= p.Config.IdleTimeout)
+}
+
+// Prewarm opens the configured number of sessions and parks them as idle.
+func (p *Pool) Prewarm(ctx context.Context) error {
+	var errs []error
+	var sessions []*Session
+	for i := 0; i < p.Config.Prewarm; i++ {
+		session, err := p.Get(ctx)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		sessions = append(sessions, session)
+	}
+	for _, session := range sessions {
+		p.Put(session)
+	}
+	return errors.Join(errs...)
+}
+
+// Get returns an idle session or opens a new one, waiting for a free slot
+// when Size sessions are in use.
+func (p *Pool) Get(ctx context.Context) (*Session, error) {
+	select {
+	case p.slots <- struct{}{}:
+	default:
+		p.mutex.Lock()
+		p.stats.waits++
+		p.mutex.Unlock()
+		select {
+		case p.slots <- struct{}{}:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	now := time.Now()
+	var stale []*Session
+	var session *Session
+	p.mutex.Lock()
+	for len(p.idle) > 0 && session == nil {
+		last := p.idle[len(p.idle)-1]
+		p.idle = p.idle[:len(p.idle)-1]
+		if p.expired(last, now) {
+			p.stats.expired++
+			stale = append(stale, last)
+			continue
+		}
+		session = last
+		p.stats.reused++
+	}
+	p.mutex.Unlock()
+
+	for _, s := range stale {
+		go p.close(s)
+	}
+
+	if session == nil {
+		var err error
+		session, err = p.open(ctx)
+		if err != nil {
+			<-p.slots
+			return nil, err
+		}
+	}
+	return session, nil
+}
+
+// Put returns a session to the pool after use.
+func (p *Pool) Put(session *Session) {
+	session.lastUsed = time.Now()
+
+	p.mutex.Lock()
+	closed := p.closed
+	if !closed {
+		p.idle = append(p.idle, session)
+	}
+	p.mutex.Unlock()
+
+	if closed {
+		p.close(session)
+	}
+	<-p.slots
+}
+
+// Discard drops a session 1C no longer accepts.
+func (p *Pool) Discard(session *Session) {
+	p.mutex.Lock()
+	p.stats.invalidated++
+	p.mutex.Unlock()
+
+	go p.close(session)
+	<-p.slots
+}
+
+// Invalid reports whether a response body says the session is no longer
+// valid, by looking for any of the configured patterns.
+func (p *Pool) Invalid(body []byte) bool {
+	text := string(body)
+	for _, pattern := range p.Config.InvalidPatterns {
+		if strings.Contains(text, pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+// Expire closes idle sessions past their age or idle limit. It runs every
+// interval until done is closed.
+func (p *Pool) Expire(interval time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-done:
+			return
+		}
+
+		now := time.Now()
+		var stale []*Session
+		p.mutex.Lock()
+		active := p.idle[:0]
+		for _, session := range p.idle {
+			if p.expired(session, now) {
+				stale = append(stale, session)
+			} else {
+				active = append(active, session)
+			}
+		}
+		p.idle = active
+		p.stats.expired += len(stale)
+		p.mutex.Unlock()
+
+		for _, session := range stale {
+			p.close(session)
+		}
+	}
+}
+
+// Close ends all idle sessions. Sessions still in use are closed when they
+// are returned.
+func (p *Pool) Close() {
+	p.mutex.Lock()
+	idle := p.idle
+	p.idle = nil
+	p.closed = true
+	p.mutex.Unlock()
+
+	for _, session := range idle {
+		p.close(session)
+	}
+}
+
+func (p *Pool) Stats() map[string]interface{} {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	avgCreation := time.Duration(0)
+	if p.stats.created > 0 {
+		avgCreation = p.stats.totalCreation / time.Duration(p.stats.created)
+	}
+	return map[string]interface{}{
+		"Created":          p.stats.created,
+		"CreateFailed":     p.stats.failed,
+		"CreatedPerSecond": float64(p.stats.created) / time.Since(p.started).Seconds(),
+		"AverageCreation":  avgCreation,
+		"Reused":           p.stats.reused,
+		"Expired":          p.stats.expired,
+		"Invalidated":      p.stats.invalidated,
+		"Closed":           p.stats.closed,
+		"CloseFailed":      p.stats.closeFailed,
+		"Waits":            p.stats.waits,
+		"InUse":            len(p.slots),
+		"Idle":             len(p.idle),
+	}
+}
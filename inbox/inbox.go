@@ -0,0 +1,436 @@
+package inbox
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Receipt records one delivery of a message to the sink.
+type Receipt struct {
+	Seq         int       `json:"seq"`
+	VerID       string    `json:"ver_id"`
+	VerNo       string    `json:"ver_no,omitempty"`
+	Src         string    `json:"src"`
+	DataType    string    `json:"data_type"`
+	Channel     string    `json:"channel,omitempty"`
+	MessageID   string    `json:"message_id,omitempty"`
+	PayloadHash string    `json:"payload_hash"`
+	Size        int       `json:"size"`
+	SentAt      time.Time `json:"sent_at"`
+	ReceivedAt  time.Time `json:"received_at"`
+}
+
+// PayloadHash is the hash receipts carry, so that a sender can compare it
+// with what it sent.
+func PayloadHash(payload string) string {
+	sum := sha256.Sum256([]byte(payload))
+	return hex.EncodeToString(sum[:])
+}
+
+// NewReceipt describes a received message. Bodies sent by the load client
+// ({"id", "payload", "timestamp"}) yield the message ID, the payload hash and
+// the send time; other bodies are hashed as a whole.
+func NewReceipt(headers http.Header, body []byte, now time.Time) *Receipt {
+	r := &Receipt{
+		VerID:       headers.Get("x-esb-ver-id"),
+		VerNo:       headers.Get("x-esb-ver-no"),
+		Src:         headers.Get("x-esb-src"),
+		DataType:    headers.Get("x-esb-data-type"),
+		Channel:     headers.Get("x-esb-channel"),
+		PayloadHash: PayloadHash(string(body)),
+		Size:        len(body),
+		ReceivedAt:  now,
+	}
+
+	var message struct {
+		ID        string    `json:"id"`
+		Payload   string    `json:"payload"`
+		Timestamp time.Time `json:"timestamp"`
+	}
+	if err := json.Unmarshal(body, &message); err == nil && message.ID != "" {
+		r.MessageID = message.ID
+		r.PayloadHash = PayloadHash(message.Payload)
+		r.SentAt = message.Timestamp
+	}
+	return r
+}
+
+// stream splits a message ID of the form <thread>-<number>, as generated by
+// the load client per thread. Client processes number their threads alike,
+// so the stream is the thread of the source system, src/<thread>.
+func (r *Receipt) stream() (string, int, bool) {
+	i := strings.LastIndex(r.MessageID, "-")
+	if i <= 0 {
+		return "", 0, false
+	}
+	n, err := strconv.Atoi(r.MessageID[i+1:])
+	if err != nil || n < 1 {
+		return "", 0, false
+	}
+	return r.Src + "/" + r.MessageID[:i], n, true
+}
+
+type Duplicate struct {
+	VerID string `json:"ver_id"`
+	Count int    `json:"count"`
+}
+
+// Range is an inclusive range of missing message numbers.
+type Range struct {
+	From int `json:"from"`
+	To   int `json:"to"`
+}
+
+// Counts summarises the inbox. SpillError is the first error writing the
+// spill file; receipts evicted since then are lost.
+type Counts struct {
+	Total      int                       `json:"total"`
+	Unique     int                       `json:"unique"`
+	Retained   int                       `json:"retained"`
+	Spilled    int                       `json:"spilled"`
+	SpillError string                    `json:"spill_error,omitempty"`
+	BySource   map[string]map[string]int `json:"by_source"`
+}
+
+// Inbox retains received messages. The most recent ones are kept in memory;
+// older ones are dropped, or appended to the spill file when there is one.
+// Counts, duplicates and gaps cover every message ever added.
+type Inbox struct {
+	capacity   int
+	retained   []*Receipt
+	byVerID    map[string][]*Receipt
+	deliveries map[string]int
+	counts     map[string]map[string]int
+	streams    map[string]map[int]bool
+	total      int
+	spilled    int
+	spillPath  string
+	spill      *os.File
+	spillBuf   *bufio.Writer
+	spillErr   error
+	mutex      sync.Mutex
+}
+
+func New(capacity int, spillPath string) (*Inbox, error) {
+	i := &Inbox{
+		capacity:   capacity,
+		byVerID:    make(map[string][]*Receipt),
+		deliveries: make(map[string]int),
+		counts:     make(map[string]map[string]int),
+		streams:    make(map[string]map[int]bool),
+		spillPath:  spillPath,
+	}
+
+	if spillPath != "" {
+		file, err := os.Create(spillPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create spill file: %w", err)
+		}
+		i.spill = file
+		i.spillBuf = bufio.NewWriter(file)
+	}
+	return i, nil
+}
+
+func (i *Inbox) Add(r *Receipt) {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	i.total++
+	r.Seq = i.total
+	// Messages without an x-esb-ver-id are counted in total but cannot be
+	// told apart, so they are neither unique nor duplicates.
+	if r.VerID != "" {
+		i.deliveries[r.VerID]++
+	}
+
+	bySource, ok := i.counts[r.Src]
+	if !ok {
+		bySource = make(map[string]int)
+		i.counts[r.Src] = bySource
+	}
+	bySource[r.DataType]++
+
+	if stream, n, ok := r.stream(); ok {
+		numbers, ok := i.streams[stream]
+		if !ok {
+			numbers = make(map[int]bool)
+			i.streams[stream] = numbers
+		}
+		numbers[n] = true
+	}
+
+	i.retained = append(i.retained, r)
+	if r.VerID != "" {
+		i.byVerID[r.VerID] = append(i.byVerID[r.VerID], r)
+	}
+	if i.capacity > 0 && len(i.retained) > i.capacity {
+		i.evict(i.retained[0])
+		i.retained = i.retained[1:]
+	}
+}
+
+func (i *Inbox) evict(r *Receipt) {
+	if receipts, ok := i.byVerID[r.VerID]; ok {
+		if receipts = receipts[1:]; len(receipts) == 0 {
+			delete(i.byVerID, r.VerID)
+		} else {
+			i.byVerID[r.VerID] = receipts
+		}
+	}
+
+	if i.spill != nil && i.spillErr == nil {
+		data, err := json.Marshal(r)
+		if err == nil {
+			_, err = i.spillBuf.Write(append(data, '\n'))
+		}
+		if err != nil {
+			i.spillErr = fmt.Errorf("failed to write spill file: %w", err)
+			return
+		}
+		i.spilled++
+	}
+}
+
+// spilledReceipts reads the receipts written to the spill file. It must be
+// called with the lock held.
+func (i *Inbox) spilledReceipts(keep func(*Receipt) bool) ([]*Receipt, error) {
+	if i.spill == nil || i.spilled == 0 {
+		return nil, nil
+	}
+	if err := i.spillBuf.Flush(); err != nil && i.spillErr == nil {
+		i.spillErr = fmt.Errorf("failed to write spill file: %w", err)
+	}
+	if i.spillErr != nil {
+		return nil, i.spillErr
+	}
+
+	file, err := os.Open(i.spillPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open spill file: %w", err)
+	}
+	defer file.Close()
+
+	var receipts []*Receipt
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		r := &Receipt{}
+		if err := json.Unmarshal(scanner.Bytes(), r); err != nil {
+			continue
+		}
+		if keep(r) {
+			receipts = append(receipts, r)
+		}
+	}
+	return receipts, scanner.Err()
+}
+
+// Messages returns the receipts kept in memory or spilled that pass keep, in
+// order of arrival.
+func (i *Inbox) Messages(keep func(*Receipt) bool) ([]*Receipt, error) {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	receipts, err := i.spilledReceipts(keep)
+	if err != nil {
+		return nil, err
+	}
+	if receipts == nil {
+		receipts = []*Receipt{}
+	}
+	for _, r := range i.retained {
+		if keep(r) {
+			receipts = append(receipts, r)
+		}
+	}
+	return receipts, nil
+}
+
+// Get returns every delivery of the x-esb-ver-id.
+func (i *Inbox) Get(verID string) ([]*Receipt, error) {
+	i.mutex.Lock()
+	retained := slices.Clone(i.byVerID[verID])
+	complete := len(retained) == i.deliveries[verID]
+	i.mutex.Unlock()
+
+	if complete {
+		return retained, nil
+	}
+	return i.Messages(func(r *Receipt) bool { return r.VerID == verID })
+}
+
+// Find returns every delivery of the x-esb-ver-id values, in order of
+// arrival.
+func (i *Inbox) Find(verIDs []string) ([]*Receipt, error) {
+	wanted := make(map[string]bool, len(verIDs))
+	receipts := []*Receipt{}
+	complete := true
+	i.mutex.Lock()
+	for _, verID := range verIDs {
+		wanted[verID] = true
+		receipts = append(receipts, i.byVerID[verID]...)
+		complete = complete && len(i.byVerID[verID]) == i.deliveries[verID]
+	}
+	i.mutex.Unlock()
+
+	if !complete {
+		return i.Messages(func(r *Receipt) bool { return wanted[r.VerID] })
+	}
+	slices.SortFunc(receipts, func(a, b *Receipt) int { return a.Seq - b.Seq })
+	return receipts, nil
+}
+
+func (i *Inbox) Counts() Counts {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	counts := Counts{
+		Total:    i.total,
+		Unique:   len(i.deliveries),
+		Retained: len(i.retained),
+		Spilled:  i.spilled,
+		BySource: make(map[string]map[string]int, len(i.counts)),
+	}
+	if i.spillErr != nil {
+		counts.SpillError = i.spillErr.Error()
+	}
+	for src, byDataType := range i.counts {
+		counts.BySource[src] = make(map[string]int, len(byDataType))
+		for dataType, count := range byDataType {
+			counts.BySource[src][dataType] = count
+		}
+	}
+	return counts
+}
+
+// Duplicates lists the x-esb-ver-id values delivered more than once.
+func (i *Inbox) Duplicates() []Duplicate {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	duplicates := []Duplicate{}
+	for verID, count := range i.deliveries {
+		if count > 1 {
+			duplicates = append(duplicates, Duplicate{VerID: verID, Count: count})
+		}
+	}
+	slices.SortFunc(duplicates, func(a, b Duplicate) int { return strings.Compare(a.VerID, b.VerID) })
+	return duplicates
+}
+
+// Gaps lists, per stream, the message numbers missing between 1 and the
+// highest number received.
+func (i *Inbox) Gaps() map[string][]Range {
+	// Message IDs are chosen by the sender and their numbers may be
+	// arbitrarily high, so gaps are found between the numbers received.
+	i.mutex.Lock()
+	streams := make(map[string][]int, len(i.streams))
+	for stream, numbers := range i.streams {
+		streams[stream] = slices.Collect(maps.Keys(numbers))
+	}
+	i.mutex.Unlock()
+
+	gaps := make(map[string][]Range)
+	for stream, numbers := range streams {
+		slices.Sort(numbers)
+		var ranges []Range
+		previous := 0
+		for _, n := range numbers {
+			if n > previous+1 {
+				ranges = append(ranges, Range{From: previous + 1, To: n - 1})
+			}
+			previous = n
+		}
+		if len(ranges) > 0 {
+			gaps[stream] = ranges
+		}
+	}
+	return gaps
+}
+
+func (i *Inbox) Close() error {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	if i.spill == nil {
+		return nil
+	}
+	err := i.spillErr
+	if flushErr := i.spillBuf.Flush(); flushErr != nil && err == nil {
+		err = fmt.Errorf("failed to write spill file: %w", flushErr)
+	}
+	if closeErr := i.spill.Close(); closeErr != nil && err == nil {
+		err = fmt.Errorf("failed to close spill file: %w", closeErr)
+	}
+	i.spill = nil
+	return err
+}
+
+// Handler serves the query API:
+//
+//	GET /api/counts                 totals by source and data type
+//	GET /api/messages               receipts, filtered by ?src=, ?data_type= and ?ver_id=
+//	GET /api/messages/{ver_id}      every delivery of one message
+//	GET /api/duplicates             messages delivered more than once
+//	GET /api/gaps                   missing message numbers per stream
+func (i *Inbox) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/counts", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, i.Counts())
+	})
+	mux.HandleFunc("GET /api/messages", func(w http.ResponseWriter, r *http.Request) {
+		src, dataType := r.URL.Query().Get("src"), r.URL.Query().Get("data_type")
+		keep := func(r *Receipt) bool {
+			return (src == "" || r.Src == src) && (dataType == "" || r.DataType == dataType)
+		}
+		var receipts []*Receipt
+		var err error
+		if verIDs := r.URL.Query()["ver_id"]; len(verIDs) > 0 {
+			receipts, err = i.Find(verIDs)
+			receipts = slices.DeleteFunc(receipts, func(r *Receipt) bool { return !keep(r) })
+		} else {
+			receipts, err = i.Messages(keep)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, receipts)
+	})
+	mux.HandleFunc("GET /api/messages/{ver_id}", func(w http.ResponseWriter, r *http.Request) {
+		receipts, err := i.Get(r.PathValue("ver_id"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if len(receipts) == 0 {
+			http.NotFound(w, r)
+			return
+		}
+		writeJSON(w, receipts)
+	})
+	mux.HandleFunc("GET /api/duplicates", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, i.Duplicates())
+	})
+	mux.HandleFunc("GET /api/gaps", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, i.Gaps())
+	})
+	return mux
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
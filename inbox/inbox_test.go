@@ -0,0 +1,148 @@
+package inbox
+
+import (
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func receipt(verID, src, messageID string) *Receipt {
+	return &Receipt{
+		VerID:      verID,
+		Src:        src,
+		DataType:   "ref:sku",
+		MessageID:  messageID,
+		ReceivedAt: time.Now(),
+	}
+}
+
+func newInbox(t *testing.T, capacity int, spillPath string) *Inbox {
+	t.Helper()
+	i, err := New(capacity, spillPath)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	t.Cleanup(func() { i.Close() })
+	return i
+}
+
+func verIDs(receipts []*Receipt) []string {
+	ids := []string{}
+	for _, r := range receipts {
+		ids = append(ids, r.VerID)
+	}
+	return ids
+}
+
+func TestCounts(t *testing.T) {
+	i := newInbox(t, 0, "")
+	i.Add(receipt("a", "sys:erp", ""))
+	i.Add(receipt("b", "sys:erp", ""))
+	i.Add(receipt("a", "sys:erp", ""))
+	i.Add(receipt("c", "sys:crm", ""))
+	// Messages without a ver-id are counted but neither unique nor duplicate.
+	i.Add(receipt("", "sys:crm", ""))
+	i.Add(receipt("", "sys:crm", ""))
+
+	want := Counts{
+		Total:    6,
+		Unique:   3,
+		Retained: 6,
+		BySource: map[string]map[string]int{
+			"sys:erp": {"ref:sku": 3},
+			"sys:crm": {"ref:sku": 3},
+		},
+	}
+	if got := i.Counts(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Counts() = %+v, want %+v", got, want)
+	}
+	if got, want := i.Duplicates(), []Duplicate{{VerID: "a", Count: 2}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Duplicates() = %+v, want %+v", got, want)
+	}
+}
+
+func TestGaps(t *testing.T) {
+	i := newInbox(t, 0, "")
+	for _, r := range []*Receipt{
+		receipt("1", "sys:erp", "thread-1-1"),
+		receipt("2", "sys:erp", "thread-1-2"),
+		receipt("3", "sys:erp", "thread-1-5"),
+		receipt("4", "sys:erp", "thread-1-9"),
+		receipt("5", "sys:crm", "thread-1-2"),
+		receipt("6", "sys:crm", "thread-2-1"),
+		receipt("7", "sys:crm", "thread-2-1000000000"),
+		receipt("8", "sys:crm", "thread-2-0"),
+		receipt("9", "sys:crm", "no-number"),
+		receipt("10", "sys:crm", ""),
+	} {
+		i.Add(r)
+	}
+
+	want := map[string][]Range{
+		"sys:erp/thread-1": {{From: 3, To: 4}, {From: 6, To: 8}},
+		"sys:crm/thread-1": {{From: 1, To: 1}},
+		"sys:crm/thread-2": {{From: 2, To: 999999999}},
+	}
+	if got := i.Gaps(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Gaps() = %v, want %v", got, want)
+	}
+}
+
+func TestSpill(t *testing.T) {
+	i := newInbox(t, 2, filepath.Join(t.TempDir(), "spill"))
+	for n := range 5 {
+		i.Add(receipt(fmt.Sprint(n), "sys:erp", ""))
+	}
+	i.Add(receipt("0", "sys:erp", ""))
+
+	if counts := i.Counts(); counts.Retained != 2 || counts.Spilled != 4 || counts.SpillError != "" {
+		t.Errorf("Counts() = %+v", counts)
+	}
+
+	messages, err := i.Messages(func(*Receipt) bool { return true })
+	if err != nil {
+		t.Fatalf("Messages: %v", err)
+	}
+	if got, want := verIDs(messages), []string{"0", "1", "2", "3", "4", "0"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Messages() = %v, want %v", got, want)
+	}
+
+	got, err := i.Get("0")
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if len(got) != 2 || got[0].Seq != 1 || got[1].Seq != 6 {
+		t.Errorf("Get(0) = %+v, want both deliveries", got)
+	}
+
+	found, err := i.Find([]string{"4", "1", "missing"})
+	if err != nil {
+		t.Fatalf("Find: %v", err)
+	}
+	if got, want := verIDs(found), []string{"1", "4"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Find() = %v, want %v", got, want)
+	}
+
+	if err := i.Close(); err != nil {
+		t.Errorf("Close: %v", err)
+	}
+}
+
+func TestRetainedOnly(t *testing.T) {
+	i := newInbox(t, 2, "")
+	for n := range 3 {
+		i.Add(receipt(fmt.Sprint(n), "sys:erp", ""))
+	}
+	messages, err := i.Messages(func(*Receipt) bool { return true })
+	if err != nil {
+		t.Fatalf("Messages: %v", err)
+	}
+	if got, want := verIDs(messages), []string{"1", "2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Messages() = %v, want %v", got, want)
+	}
+	if counts := i.Counts(); counts.Total != 3 || counts.Spilled != 0 {
+		t.Errorf("Counts() = %+v", counts)
+	}
+}
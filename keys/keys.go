@@ -0,0 +1,280 @@
+package keys
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"stress/registry"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Key is an x-esb-key value. Owner, when set, is the only x-esb-src allowed
+// to use the key. NotBefore and NotAfter bound its validity, so that during a
+// rotation the old and the new key of a system can overlap.
+type Key struct {
+	Key       string    `yaml:"key"`
+	Owner     string    `yaml:"owner"`
+	NotBefore time.Time `yaml:"not_before"`
+	NotAfter  time.Time `yaml:"not_after"`
+	Revoked   bool      `yaml:"revoked"`
+}
+
+type Error struct {
+	Code    string
+	Message string
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+const (
+	CodeUnknownKey     = "unknown_key"
+	CodeRevokedKey     = "revoked_key"
+	CodeExpiredKey     = "expired_key"
+	CodeKeyNotYetValid = "key_not_yet_valid"
+	CodeOwnerMismatch  = "key_owner_mismatch"
+)
+
+// Hash is the only form in which a key may be logged.
+func Hash(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:8])
+}
+
+// Redact returns a copy of the headers with x-esb-key values replaced by their
+// hashes, for logging.
+func Redact(headers http.Header) http.Header {
+	values := headers.Values("x-esb-key")
+	if len(values) == 0 {
+		return headers
+	}
+	redacted := headers.Clone()
+	redacted.Del("x-esb-key")
+	for _, value := range values {
+		redacted.Add("x-esb-key", "sha256:"+Hash(value))
+	}
+	return redacted
+}
+
+// Ring is the set of accepted keys. Keys given to NewRing are static, keys
+// read from the file are replaced on every Reload. A later entry for the same
+// key overrides an earlier one, so the file can revoke a static key.
+type Ring struct {
+	path     string
+	static   []Key
+	keys     map[string]*Key
+	modTime  time.Time
+	rejected map[string]int
+	accepted int
+	reloads  int
+	mutex    sync.RWMutex
+}
+
+func NewRing(path string, static []Key) (*Ring, error) {
+	r := &Ring{
+		path:     path,
+		static:   static,
+		rejected: make(map[string]int),
+	}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// ParseEnv parses keys in the form "owner=key,owner=key". The owner part is
+// optional.
+func ParseEnv(value string) []Key {
+	var keys []Key
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		var k Key
+		if owner, key, ok := strings.Cut(item, "="); ok {
+			k.Owner, k.Key = strings.TrimSpace(owner), strings.TrimSpace(key)
+		} else {
+			k.Key = item
+		}
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// FromRegistry returns the keys held in systems.addr, owned by their system.
+// Keys of inactive systems are revoked.
+func FromRegistry(reg *registry.Registry) []Key {
+	var keys []Key
+	for _, s := range reg.Systems {
+		if s.Addr == "" {
+			continue
+		}
+		keys = append(keys, Key{Key: s.Addr, Owner: s.SystemID, Revoked: !s.Active})
+	}
+	return keys
+}
+
+func loadFile(path string) ([]Key, time.Time, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("failed to read keys file: %w", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("failed to read keys file: %w", err)
+	}
+
+	var file struct {
+		Keys []Key `yaml:"keys"`
+	}
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return nil, time.Time{}, fmt.Errorf("failed to parse keys file: %w", err)
+	}
+	return file.Keys, info.ModTime(), nil
+}
+
+// Reload rereads the keys file. On error the previous keys stay in effect.
+func (r *Ring) Reload() error {
+	all := r.static
+	var modTime time.Time
+	if r.path != "" {
+		fileKeys, mt, err := loadFile(r.path)
+		if err != nil {
+			return err
+		}
+		all = append(append([]Key(nil), r.static...), fileKeys...)
+		modTime = mt
+	}
+
+	keys := make(map[string]*Key, len(all))
+	for i := range all {
+		k := all[i]
+		if k.Key == "" {
+			return fmt.Errorf("empty key for owner %q", k.Owner)
+		}
+		keys[k.Key] = &k
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.keys = keys
+	r.modTime = modTime
+	r.reloads++
+	return nil
+}
+
+// Watch reloads the keys file whenever its modification time changes, until
+// done is closed. onReload is called with the result of every reload.
+func (r *Ring) Watch(interval time.Duration, done <-chan struct{}, onReload func(count int, err error)) {
+	if r.path == "" {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			info, err := os.Stat(r.path)
+			if err != nil {
+				onReload(r.Len(), fmt.Errorf("failed to read keys file: %w", err))
+				continue
+			}
+
+			r.mutex.RLock()
+			changed := !info.ModTime().Equal(r.modTime)
+			r.mutex.RUnlock()
+			if changed {
+				err := r.Reload()
+				onReload(r.Len(), err)
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+func (r *Ring) Len() int {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	return len(r.keys)
+}
+
+// Authenticate checks that the key is known and valid at the given time and
+// that it belongs to the source system.
+func (r *Ring) Authenticate(key, src string, now time.Time) (*Key, error) {
+	r.mutex.RLock()
+	k, ok := r.keys[key]
+	r.mutex.RUnlock()
+
+	var err *Error
+	switch {
+	case !ok:
+		err = &Error{Code: CodeUnknownKey, Message: "Unknown x-esb-key " + Hash(key)}
+	case k.Revoked:
+		err = &Error{Code: CodeRevokedKey, Message: "Revoked x-esb-key " + Hash(key)}
+	case !k.NotBefore.IsZero() && now.Before(k.NotBefore):
+		err = &Error{Code: CodeKeyNotYetValid, Message: fmt.Sprintf("x-esb-key %s is not valid before %s", Hash(key), k.NotBefore.Format(time.RFC3339))}
+	case !k.NotAfter.IsZero() && !now.Before(k.NotAfter):
+		err = &Error{Code: CodeExpiredKey, Message: fmt.Sprintf("x-esb-key %s expired at %s", Hash(key), k.NotAfter.Format(time.RFC3339))}
+	case k.Owner != "" && k.Owner != src:
+		err = &Error{Code: CodeOwnerMismatch, Message: fmt.Sprintf("x-esb-key %s does not belong to %q", Hash(key), src)}
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if err != nil {
+		r.rejected[err.Code]++
+		return nil, err
+	}
+	r.accepted++
+	return k, nil
+}
+
+// Secrets returns the keys the source system may currently use, for checking
+// request signatures.
+func (r *Ring) Secrets(src string, now time.Time) []string {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	var secrets []string
+	for key, k := range r.keys {
+		if k.Revoked || (k.Owner != "" && k.Owner != src) {
+			continue
+		}
+		if (!k.NotBefore.IsZero() && now.Before(k.NotBefore)) || (!k.NotAfter.IsZero() && !now.Before(k.NotAfter)) {
+			continue
+		}
+		secrets = append(secrets, key)
+	}
+	return secrets
+}
+
+func (r *Ring) Stats() map[string]interface{} {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	rejected := make(map[string]int, len(r.rejected))
+	for code, count := range r.rejected {
+		rejected[code] = count
+	}
+	return map[string]interface{}{
+		"Keys":     len(r.keys),
+		"Reloads":  r.reloads,
+		"Accepted": r.accepted,
+		"Rejected": rejected,
+	}
+}
@@ -0,0 +1,372 @@
+package limit
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"stress/keys"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	ScopeGlobal = "global"
+	ScopeSource = "src"
+	ScopeKey    = "key"
+)
+
+const (
+	CodeRateLimited = "rate_limited"
+	CodeInFlight    = "too_many_in_flight"
+)
+
+type Error struct {
+	Code       string
+	Scope      string
+	Message    string
+	RetryAfter time.Duration
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// Header names the request header that selected the exhausted limit.
+func (e *Error) Header() string {
+	switch e.Scope {
+	case ScopeSource:
+		return "x-esb-src"
+	case ScopeKey:
+		return "x-esb-key"
+	}
+	return ""
+}
+
+// RetryAfterSeconds formats RetryAfter for the Retry-After header, rounded
+// up to whole seconds.
+func (e *Error) RetryAfterSeconds() string {
+	return strconv.Itoa(max(1, int(math.Ceil(e.RetryAfter.Seconds()))))
+}
+
+// Limit is a token bucket refilled at Rate requests per second holding up to
+// Burst tokens, and a cap of MaxInFlight concurrent requests. Zero disables
+// either part.
+type Limit struct {
+	Rate        float64 `yaml:"rate"`
+	Burst       int     `yaml:"burst"`
+	MaxInFlight int     `yaml:"max_in_flight"`
+}
+
+func (l Limit) enabled() bool {
+	return l.Rate > 0 || l.MaxInFlight > 0
+}
+
+// Config holds the limits of every scope. Sources overrides PerSource for
+// individual systems. A request waits up to Wait for a token or a free slot
+// before it is rejected.
+type Config struct {
+	Global    Limit            `yaml:"global"`
+	PerSource Limit            `yaml:"per_source"`
+	PerKey    Limit            `yaml:"per_key"`
+	Sources   map[string]Limit `yaml:"sources"`
+	Wait      time.Duration    `yaml:"wait"`
+}
+
+func LoadConfig(path string) (Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Config{}, fmt.Errorf("failed to read limits file: %w", err)
+	}
+
+	var config Config
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return Config{}, fmt.Errorf("failed to parse limits file: %w", err)
+	}
+	return config, nil
+}
+
+type gateStats struct {
+	allowed     int
+	rateLimited int
+	inFlight    int
+	waited      int
+	waitTime    time.Duration
+}
+
+type gate struct {
+	name   string
+	scope  string
+	limit  Limit
+	tokens float64
+	last   time.Time
+	used   time.Time
+	slots  chan struct{}
+	stats  gateStats
+}
+
+func newGate(name, scope string, limit Limit, now time.Time) *gate {
+	g := &gate{name: name, scope: scope, limit: limit, last: now, used: now}
+	if limit.Rate > 0 {
+		g.limit.Burst = max(limit.Burst, 1)
+		g.tokens = float64(g.limit.Burst)
+	}
+	if limit.MaxInFlight > 0 {
+		g.slots = make(chan struct{}, limit.MaxInFlight)
+	}
+	return g
+}
+
+// reserve takes a token, possibly ahead of time, and returns how long the
+// caller has to wait for it. It fails when that is longer than maxWait.
+func (g *gate) reserve(now time.Time, maxWait time.Duration) (time.Duration, bool) {
+	if g.limit.Rate <= 0 {
+		return 0, true
+	}
+
+	g.tokens = min(float64(g.limit.Burst), g.tokens+now.Sub(g.last).Seconds()*g.limit.Rate)
+	g.last = now
+
+	var delay time.Duration
+	if g.tokens < 1 {
+		delay = time.Duration((1 - g.tokens) / g.limit.Rate * float64(time.Second))
+	}
+	if delay > maxWait {
+		return delay, false
+	}
+	g.tokens--
+	return delay, true
+}
+
+// idleTimeout is how long per-source and per-key gates are kept after their
+// last request. Their names come from request headers, so they are dropped
+// once idle to bound memory; a dropped gate is recreated with a full bucket.
+const idleTimeout = 5 * time.Minute
+
+// idle reports whether the gate is unused for long enough that dropping it
+// loses nothing: no request holds a slot and its bucket has refilled.
+func (g *gate) idle(now time.Time) bool {
+	if now.Sub(g.used) < idleTimeout || len(g.slots) > 0 {
+		return false
+	}
+	return g.limit.Rate <= 0 || g.tokens+now.Sub(g.last).Seconds()*g.limit.Rate >= float64(g.limit.Burst)
+}
+
+type Limiter struct {
+	Config  Config
+	global  *gate
+	sources map[string]*gate
+	keys    map[string]*gate
+	swept   time.Time
+	mutex   sync.Mutex
+}
+
+func NewLimiter(config Config) *Limiter {
+	return &Limiter{
+		Config:  config,
+		global:  newGate(ScopeGlobal, ScopeGlobal, config.Global, time.Now()),
+		sources: make(map[string]*gate),
+		keys:    make(map[string]*gate),
+		swept:   time.Now(),
+	}
+}
+
+func (l *Limiter) gates(src, key string, now time.Time) []*gate {
+	if now.Sub(l.swept) >= idleTimeout {
+		l.sweep(now)
+	}
+	gates := []*gate{l.global}
+
+	limit, ok := l.Config.Sources[src]
+	if !ok {
+		limit = l.Config.PerSource
+	}
+	if limit.enabled() {
+		g, ok := l.sources[src]
+		if !ok {
+			g = newGate(ScopeSource+":"+src, ScopeSource, limit, now)
+			l.sources[src] = g
+		}
+		gates = append(gates, g)
+	}
+
+	if l.Config.PerKey.enabled() {
+		g, ok := l.keys[key]
+		if !ok {
+			g = newGate(ScopeKey+":"+keys.Hash(key), ScopeKey, l.Config.PerKey, now)
+			l.keys[key] = g
+		}
+		gates = append(gates, g)
+	}
+	for _, g := range gates {
+		g.used = now
+	}
+	return gates
+}
+
+// sweep drops the idle per-source and per-key gates, along with their stats.
+func (l *Limiter) sweep(now time.Time) {
+	for src, g := range l.sources {
+		if g.idle(now) {
+			delete(l.sources, src)
+		}
+	}
+	for key, g := range l.keys {
+		if g.idle(now) {
+			delete(l.keys, key)
+		}
+	}
+	l.swept = now
+}
+
+// refund returns the tokens reserved from the gates of a rejected request.
+func refund(gates []*gate) {
+	for _, g := range gates {
+		if g.limit.Rate > 0 {
+			g.tokens++
+		}
+	}
+}
+
+// Acquire admits a request from the source with the key, waiting up to the
+// configured time for tokens and in-flight slots. On success the returned
+// function must be called when the request is done; otherwise the error is
+// an *Error.
+func (l *Limiter) Acquire(ctx context.Context, src, key string) (func(), error) {
+	startTime := time.Now()
+	deadline := startTime.Add(l.Config.Wait)
+
+	l.mutex.Lock()
+	gates := l.gates(src, key, startTime)
+	var delay time.Duration
+	for i, g := range gates {
+		d, ok := g.reserve(startTime, l.Config.Wait)
+		if !ok {
+			refund(gates[:i])
+			g.stats.rateLimited++
+			l.mutex.Unlock()
+			return nil, &Error{
+				Code:       CodeRateLimited,
+				Scope:      g.scope,
+				Message:    fmt.Sprintf("Rate limit of %s exceeded", g.name),
+				RetryAfter: d,
+			}
+		}
+		delay = max(delay, d)
+	}
+	l.mutex.Unlock()
+
+	if delay > 0 {
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			l.mutex.Lock()
+			refund(gates)
+			l.mutex.Unlock()
+			return nil, ctx.Err()
+		}
+	}
+
+	var acquired []*gate
+	release := func() {
+		for _, g := range acquired {
+			<-g.slots
+		}
+	}
+	for _, g := range gates {
+		if g.slots == nil {
+			continue
+		}
+		if err := l.occupy(ctx, g, deadline); err != nil {
+			release()
+			l.mutex.Lock()
+			refund(gates)
+			l.mutex.Unlock()
+			return nil, err
+		}
+		acquired = append(acquired, g)
+	}
+
+	waited := time.Since(startTime)
+	l.mutex.Lock()
+	for _, g := range gates {
+		g.stats.allowed++
+		if waited > time.Millisecond {
+			g.stats.waited++
+			g.stats.waitTime += waited
+		}
+	}
+	l.mutex.Unlock()
+	return release, nil
+}
+
+func (l *Limiter) occupy(ctx context.Context, g *gate, deadline time.Time) error {
+	select {
+	case g.slots <- struct{}{}:
+		return nil
+	default:
+	}
+
+	rejected := &Error{
+		Code:       CodeInFlight,
+		Scope:      g.scope,
+		Message:    fmt.Sprintf("Too many requests in flight for %s", g.name),
+		RetryAfter: time.Second,
+	}
+	wait := time.Until(deadline)
+	if wait > 0 {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		select {
+		case g.slots <- struct{}{}:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+
+	l.mutex.Lock()
+	g.stats.inFlight++
+	l.mutex.Unlock()
+	return rejected
+}
+
+func (l *Limiter) Stats() map[string]interface{} {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	result := make(map[string]interface{}, 1+len(l.sources)+len(l.keys))
+	for _, g := range l.allGates() {
+		avgWait := time.Duration(0)
+		if g.stats.waited > 0 {
+			avgWait = g.stats.waitTime / time.Duration(g.stats.waited)
+		}
+		result[g.name] = map[string]interface{}{
+			"Allowed":          g.stats.allowed,
+			"RateLimited":      g.stats.rateLimited,
+			"InFlightRejected": g.stats.inFlight,
+			"InFlight":         len(g.slots),
+			"Waited":           g.stats.waited,
+			"AverageWait":      avgWait,
+		}
+	}
+	return result
+}
+
+func (l *Limiter) allGates() []*gate {
+	gates := []*gate{l.global}
+	for _, g := range l.sources {
+		gates = append(gates, g)
+	}
+	for _, g := range l.keys {
+		gates = append(gates, g)
+	}
+	return gates
+}
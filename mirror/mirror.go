@@ -0,0 +1,249 @@
+package mirror
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Result is the outcome of one request to the primary or to a shadow.
+type Result struct {
+	Status   int
+	Duration time.Duration
+	BodyHash string
+	Err      error
+}
+
+type shadowStats struct {
+	mirrored       int
+	skipped        int
+	failed         int
+	statusMismatch int
+	bodyMismatch   int
+	latencyDelta   time.Duration
+}
+
+type Shadow struct {
+	URL     *url.URL
+	Percent float64
+	stats   shadowStats
+}
+
+// Mirror copies a share of the requests to shadow upstreams. Shadow
+// responses are discarded after they are compared with the primary one.
+type Mirror struct {
+	Shadows  []*Shadow
+	client   *http.Client
+	inFlight chan struct{}
+	mutex    sync.Mutex
+}
+
+// New creates a mirror for a comma-separated list of shadow URLs. A URL may
+// carry its own percentage as url=percent.
+func New(list string, percent float64, timeout time.Duration, maxInFlight int) (*Mirror, error) {
+	if maxInFlight <= 0 {
+		return nil, fmt.Errorf("invalid mirror in-flight limit %d, must be positive", maxInFlight)
+	}
+	m := &Mirror{
+		client:   &http.Client{Timeout: timeout},
+		inFlight: make(chan struct{}, maxInFlight),
+	}
+
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		shadow := &Shadow{Percent: percent}
+		if i := strings.LastIndex(item, "="); i > 0 {
+			if _, err := fmt.Sscanf(item[i+1:], "%g", &shadow.Percent); err != nil {
+				return nil, fmt.Errorf("invalid mirror percentage in %q", item)
+			}
+			item = item[:i]
+		}
+		u, err := url.Parse(item)
+		if err != nil {
+			return nil, fmt.Errorf("invalid mirror %q: %w", item, err)
+		}
+		shadow.URL = u
+		m.Shadows = append(m.Shadows, shadow)
+	}
+
+	if len(m.Shadows) == 0 {
+		return nil, fmt.Errorf("no mirrors")
+	}
+	return m, nil
+}
+
+// Pending holds the shadow requests started for one primary request.
+type Pending struct {
+	mirror  *Mirror
+	shadows []*Shadow
+	results []chan Result
+}
+
+// Start sends the request to the shadows selected by their percentage. It
+// returns nil when no shadow was selected.
+func (m *Mirror) Start(r *http.Request, body []byte) *Pending {
+	var p *Pending
+	for _, shadow := range m.Shadows {
+		if rand.Float64()*100 >= shadow.Percent {
+			continue
+		}
+
+		select {
+		case m.inFlight <- struct{}{}:
+		default:
+			m.mutex.Lock()
+			shadow.stats.skipped++
+			m.mutex.Unlock()
+			continue
+		}
+
+		if p == nil {
+			p = &Pending{mirror: m}
+		}
+		result := make(chan Result, 1)
+		p.shadows = append(p.shadows, shadow)
+		p.results = append(p.results, result)
+
+		req := r.Clone(context.Background())
+		go func() {
+			defer func() { <-m.inFlight }()
+			result <- m.send(shadow, req, body)
+		}()
+	}
+	return p
+}
+
+func (m *Mirror) send(shadow *Shadow, r *http.Request, body []byte) Result {
+	target := *shadow.URL
+	target.Path = strings.TrimSuffix(target.Path, "/") + r.URL.Path
+	target.RawQuery = r.URL.RawQuery
+
+	req, err := http.NewRequest(r.Method, target.String(), bytes.NewReader(body))
+	if err != nil {
+		return Result{Err: err}
+	}
+	req.Header = r.Header.Clone()
+
+	startTime := time.Now()
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return Result{Duration: time.Since(startTime), Err: err}
+	}
+	defer resp.Body.Close()
+
+	h := sha256.New()
+	_, err = io.Copy(h, resp.Body)
+	return Result{
+		Status:   resp.StatusCode,
+		Duration: time.Since(startTime),
+		BodyHash: hex.EncodeToString(h.Sum(nil)),
+		Err:      err,
+	}
+}
+
+// Compare waits for the shadow results and reports each of them together
+// with the primary result.
+func (p *Pending) Compare(primary Result, report func(shadow *url.URL, primary, result Result)) {
+	for i, shadow := range p.shadows {
+		result := <-p.results[i]
+		p.mirror.record(shadow, primary, result)
+		report(shadow.URL, primary, result)
+	}
+}
+
+func (m *Mirror) record(shadow *Shadow, primary, result Result) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	shadow.stats.mirrored++
+	if result.Err != nil {
+		shadow.stats.failed++
+		return
+	}
+	if result.Status != primary.Status {
+		shadow.stats.statusMismatch++
+	} else if result.BodyHash != primary.BodyHash {
+		shadow.stats.bodyMismatch++
+	}
+	shadow.stats.latencyDelta += result.Duration - primary.Duration
+}
+
+func (m *Mirror) Stats() map[string]interface{} {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	result := make(map[string]interface{}, len(m.Shadows))
+	for _, shadow := range m.Shadows {
+		stats := shadow.stats
+		avgDelta := time.Duration(0)
+		if compared := stats.mirrored - stats.failed; compared > 0 {
+			avgDelta = time.Duration(int64(stats.latencyDelta) / int64(compared))
+		}
+		result[shadow.URL.String()] = map[string]interface{}{
+			"Mirrored":            stats.mirrored,
+			"Skipped":             stats.skipped,
+			"Failed":              stats.failed,
+			"StatusMismatch":      stats.statusMismatch,
+			"BodyMismatch":        stats.bodyMismatch,
+			"AverageLatencyDelta": avgDelta,
+		}
+	}
+	return result
+}
+
+// Recorder captures the status and a hash of the body written to the
+// primary response.
+type Recorder struct {
+	http.ResponseWriter
+	status  int
+	hash    hash.Hash
+	written bool
+}
+
+func NewRecorder(w http.ResponseWriter) *Recorder {
+	return &Recorder{ResponseWriter: w, status: http.StatusOK, hash: sha256.New()}
+}
+
+func (r *Recorder) WriteHeader(statusCode int) {
+	r.status = statusCode
+	r.written = true
+	r.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (r *Recorder) Write(p []byte) (int, error) {
+	r.written = true
+	r.hash.Write(p)
+	return r.ResponseWriter.Write(p)
+}
+
+// Written reports whether a response was sent at all.
+func (r *Recorder) Written() bool {
+	return r.written
+}
+
+func (r *Recorder) Flush() {
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (r *Recorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+func (r *Recorder) Result(duration time.Duration) Result {
+	return Result{Status: r.status, Duration: duration, BodyHash: hex.EncodeToString(r.hash.Sum(nil))}
+}
@@ -0,0 +1,316 @@
+package mock
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"stress/chaos"
+	"stress/ibsession"
+	"stress/routing"
+
+	"github.com/google/uuid"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	OutcomeOK           = "ok"
+	OutcomeUnauthorized = "unauthorized"
+	OutcomeSessionError = "session_error"
+	OutcomeError        = "error"
+	OutcomeScripted     = "scripted"
+)
+
+// Response is a scripted reply to messages of the data types matching the
+// LIKE pattern, sent with the given probability (always when zero).
+type Response struct {
+	DataType    string            `yaml:"data_type"`
+	Probability float64           `yaml:"probability"`
+	Status      int               `yaml:"status"`
+	Body        string            `yaml:"body"`
+	Headers     map[string]string `yaml:"headers"`
+	Latency     *chaos.Latency    `yaml:"latency"`
+}
+
+// Config of the mock 1C service. Without users basic auth is not checked.
+// Sessions expire after SessionTTL without use and are dropped at random with
+// SessionErrorRate; at most MaxSessions are open at a time.
+type Config struct {
+	Users            map[string]string `yaml:"users"`
+	RequireSession   bool              `yaml:"require_session"`
+	SessionTTL       time.Duration     `yaml:"session_ttl"`
+	MaxSessions      int               `yaml:"max_sessions"`
+	SessionErrorRate float64           `yaml:"session_error_rate"`
+	SessionError     Response          `yaml:"session_error"`
+	Latency          *chaos.Latency    `yaml:"latency"`
+	ErrorRate        float64           `yaml:"error_rate"`
+	Error            Response          `yaml:"error"`
+	Responses        []Response        `yaml:"responses"`
+}
+
+func Load(path string) (Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Config{}, fmt.Errorf("failed to read mock file: %w", err)
+	}
+
+	var config Config
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return Config{}, fmt.Errorf("failed to parse mock file: %w", err)
+	}
+	return config, nil
+}
+
+type session struct {
+	lastUsed time.Time
+}
+
+// Service mimics the ESB HTTP service of a 1C infobase: the /info session
+// handshake and the /msg endpoint.
+type Service struct {
+	Config   Config
+	sessions map[string]*session
+	stats    map[string]int
+	started  int
+	finished int
+	expired  int
+	mutex    sync.Mutex
+}
+
+func NewService(config Config) *Service {
+	if config.SessionError.Status == 0 {
+		config.SessionError.Status = http.StatusBadRequest
+	}
+	if config.SessionError.Body == "" {
+		config.SessionError.Body = "Session error"
+	}
+	if config.Error.Status == 0 {
+		config.Error.Status = http.StatusInternalServerError
+	}
+	if config.Error.Body == "" {
+		config.Error.Body = http.StatusText(config.Error.Status)
+	}
+	for _, latency := range append([]*chaos.Latency{config.Latency}, scriptedLatencies(config.Responses)...) {
+		if latency != nil && latency.Distribution == "" {
+			latency.Distribution = chaos.DistributionFixed
+		}
+	}
+
+	return &Service{
+		Config:   config,
+		sessions: make(map[string]*session),
+		stats:    make(map[string]int),
+	}
+}
+
+func scriptedLatencies(responses []Response) []*chaos.Latency {
+	var latencies []*chaos.Latency
+	for _, response := range responses {
+		latencies = append(latencies, response.Latency)
+	}
+	return latencies
+}
+
+func (s *Service) record(outcome string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.stats[outcome]++
+}
+
+// authenticate checks basic auth, answering 401 when it fails.
+func (s *Service) authenticate(w http.ResponseWriter, r *http.Request) bool {
+	if len(s.Config.Users) == 0 {
+		return true
+	}
+
+	user, password, ok := r.BasicAuth()
+	expected, known := s.Config.Users[user]
+	if ok && known && subtle.ConstantTimeCompare([]byte(password), []byte(expected)) == 1 {
+		return true
+	}
+
+	s.record(OutcomeUnauthorized)
+	w.Header().Set("WWW-Authenticate", `Basic realm="1C"`)
+	http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+	return false
+}
+
+// HandleInfo serves the session handshake: the IBSession header starts a
+// session, returned in the ibsession cookie, or finishes the one in the
+// cookie.
+func (s *Service) HandleInfo(w http.ResponseWriter, r *http.Request) {
+	if !s.authenticate(w, r) {
+		return
+	}
+
+	switch r.Header.Get("IBSession") {
+	case "start":
+		now := time.Now()
+		s.mutex.Lock()
+		s.expire(now)
+		if s.Config.MaxSessions > 0 && len(s.sessions) >= s.Config.MaxSessions {
+			s.mutex.Unlock()
+			s.record(OutcomeSessionError)
+			http.Error(w, "Too many sessions", http.StatusServiceUnavailable)
+			return
+		}
+		id := uuid.New().String()
+		s.sessions[id] = &session{lastUsed: now}
+		s.started++
+		s.mutex.Unlock()
+
+		http.SetCookie(w, &http.Cookie{Name: ibsession.CookieName, Value: id, Path: "/", HttpOnly: true})
+	case "finish":
+		if cookie, err := r.Cookie(ibsession.CookieName); err == nil {
+			s.mutex.Lock()
+			if _, ok := s.sessions[cookie.Value]; ok {
+				delete(s.sessions, cookie.Value)
+				s.finished++
+			}
+			s.mutex.Unlock()
+		}
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// expire drops the sessions idle longer than the TTL. It must be called with
+// the lock held.
+func (s *Service) expire(now time.Time) {
+	if s.Config.SessionTTL <= 0 {
+		return
+	}
+	for id, sess := range s.sessions {
+		if now.Sub(sess.lastUsed) >= s.Config.SessionTTL {
+			delete(s.sessions, id)
+			s.expired++
+		}
+	}
+}
+
+// checkSession reports whether the request carries a live session, or none
+// when sessions are optional.
+func (s *Service) checkSession(r *http.Request) bool {
+	cookie, err := r.Cookie(ibsession.CookieName)
+	if err != nil {
+		return !s.Config.RequireSession
+	}
+
+	now := time.Now()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	sess, ok := s.sessions[cookie.Value]
+	if !ok {
+		return false
+	}
+	if s.Config.SessionTTL > 0 && now.Sub(sess.lastUsed) >= s.Config.SessionTTL {
+		delete(s.sessions, cookie.Value)
+		s.expired++
+		return false
+	}
+	if rand.Float64() < s.Config.SessionErrorRate {
+		delete(s.sessions, cookie.Value)
+		s.expired++
+		return false
+	}
+	sess.lastUsed = now
+	return true
+}
+
+func (s *Service) script(r *http.Request) *Response {
+	dataType := r.Header.Get("x-esb-data-type")
+	for i := range s.Config.Responses {
+		response := &s.Config.Responses[i]
+		if response.DataType != "" && !routing.Like(dataType, response.DataType) {
+			continue
+		}
+		if response.Probability > 0 && rand.Float64() >= response.Probability {
+			continue
+		}
+		return response
+	}
+	return nil
+}
+
+// HandleMsg accepts a message and returns the outcome and the status it was
+// answered with.
+func (s *Service) HandleMsg(w http.ResponseWriter, r *http.Request) (string, int) {
+	if !s.authenticate(w, r) {
+		return OutcomeUnauthorized, http.StatusUnauthorized
+	}
+
+	if !s.checkSession(r) {
+		s.record(OutcomeSessionError)
+		return OutcomeSessionError, s.Config.SessionError.write(w)
+	}
+
+	var delay time.Duration
+	if s.Config.Latency != nil {
+		delay = s.Config.Latency.Sample()
+	}
+
+	outcome := OutcomeOK
+	response := s.script(r)
+	switch {
+	case response != nil:
+		outcome = OutcomeScripted
+		if response.Latency != nil {
+			delay += response.Latency.Sample()
+		}
+	case rand.Float64() < s.Config.ErrorRate:
+		outcome = OutcomeError
+		response = &s.Config.Error
+	}
+
+	if delay > 0 {
+		select {
+		case <-time.After(delay):
+		case <-r.Context().Done():
+			return outcome, 0
+		}
+	}
+
+	s.record(outcome)
+	if response == nil {
+		w.WriteHeader(http.StatusOK)
+		return outcome, http.StatusOK
+	}
+	return outcome, response.write(w)
+}
+
+func (response *Response) write(w http.ResponseWriter) int {
+	for header, value := range response.Headers {
+		w.Header().Set(header, value)
+	}
+	status := response.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(response.Body)))
+	w.WriteHeader(status)
+	w.Write([]byte(response.Body))
+	return status
+}
+
+func (s *Service) Stats() map[string]interface{} {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	outcomes := make(map[string]int, len(s.stats))
+	for outcome, count := range s.stats {
+		outcomes[outcome] = count
+	}
+	return map[string]interface{}{
+		"Outcomes":         outcomes,
+		"Sessions":         len(s.sessions),
+		"SessionsStarted":  s.started,
+		"SessionsFinished": s.finished,
+		"SessionsExpired":  s.expired,
+	}
+}
@@ -0,0 +1,172 @@
+package ordering
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+const VersionLayout = "20060102T150405"
+
+const (
+	ModeTrack  = "track"
+	ModeReject = "reject"
+	ModePark   = "park"
+)
+
+type Key struct {
+	SrcSystem string `json:"src"`
+	DataType  string `json:"data_type"`
+	EntityID  string `json:"entity_id"`
+}
+
+type ParkedMessage struct {
+	Key      Key       `json:"key"`
+	VerID    string    `json:"ver_id"`
+	Version  time.Time `json:"ver_no"`
+	Latest   time.Time `json:"latest_ver_no"`
+	ParkedAt time.Time `json:"parked_at"`
+	Body     string    `json:"body"`
+}
+
+type entity struct {
+	key     Key
+	latest  time.Time
+	pending int
+}
+
+// Tracker remembers the latest accepted x-esb-ver-no for every entity and
+// classifies incoming versions against it. Once capacity entities are known
+// the least recently seen one without messages in flight is forgotten.
+type Tracker struct {
+	Mode      string
+	capacity  int
+	entities  map[Key]*list.Element
+	order     *list.List
+	parked    []ParkedMessage
+	parkLimit int
+	mutex     sync.Mutex
+	accepted  int
+	stale     int
+	reordered int
+	dropped   int
+	evicted   int
+}
+
+func NewTracker(mode string, capacity, parkLimit int) *Tracker {
+	return &Tracker{
+		Mode:      mode,
+		capacity:  capacity,
+		entities:  make(map[Key]*list.Element),
+		order:     list.New(),
+		parkLimit: parkLimit,
+	}
+}
+
+// Reserve reports whether version is not older than the latest accepted one
+// for the key, which it also returns. Older versions are counted as
+// reordered and, in track mode, still let through. A version let through is
+// only accepted by Commit once the message is; Release drops it instead, so
+// a failed message does not make its own retry or older versions stale.
+func (t *Tracker) Reserve(key Key, version time.Time) (bool, time.Time) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	e := t.entity(key)
+	if !e.latest.IsZero() && version.Before(e.latest) {
+		t.reordered++
+		if t.Mode != ModeTrack {
+			t.stale++
+			return false, e.latest
+		}
+	}
+	e.pending++
+	return true, e.latest
+}
+
+// Commit makes a reserved version the latest for the key unless a newer one
+// was accepted meanwhile.
+func (t *Tracker) Commit(key Key, version time.Time) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	e := t.entity(key)
+	e.pending--
+	if version.After(e.latest) {
+		e.latest = version
+	}
+	t.accepted++
+}
+
+// Release drops a reserved version of a message that was not accepted.
+func (t *Tracker) Release(key Key) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.entity(key).pending--
+}
+
+// entity returns the state of the key, creating it when needed. It must be
+// called with the lock held.
+func (t *Tracker) entity(key Key) *entity {
+	if el, ok := t.entities[key]; ok {
+		t.order.MoveToFront(el)
+		return el.Value.(*entity)
+	}
+
+	e := &entity{key: key}
+	t.entities[key] = t.order.PushFront(e)
+	for el := t.order.Back(); el != nil && t.capacity > 0 && t.order.Len() > t.capacity; {
+		prev := el.Prev()
+		if old := el.Value.(*entity); old.pending == 0 && old != e {
+			t.order.Remove(el)
+			delete(t.entities, old.key)
+			t.evicted++
+		}
+		el = prev
+	}
+	return e
+}
+
+// Park keeps a stale message for inspection through Parked. A message parked
+// again, when its sender retries, is kept once. The oldest parked message is
+// dropped once the limit is reached.
+func (t *Tracker) Park(msg ParkedMessage) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	for _, parked := range t.parked {
+		if msg.VerID != "" && parked.VerID == msg.VerID {
+			return
+		}
+	}
+
+	msg.ParkedAt = time.Now()
+	t.parked = append(t.parked, msg)
+	if t.parkLimit > 0 && len(t.parked) > t.parkLimit {
+		t.parked = t.parked[1:]
+		t.dropped++
+	}
+}
+
+func (t *Tracker) Parked() []ParkedMessage {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	return append([]ParkedMessage{}, t.parked...)
+}
+
+func (t *Tracker) Stats() map[string]interface{} {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	return map[string]interface{}{
+		"Entities":  len(t.entities),
+		"Evicted":   t.evicted,
+		"Accepted":  t.accepted,
+		"Stale":     t.stale,
+		"Reordered": t.reordered,
+		"Parked":    len(t.parked),
+		"Dropped":   t.dropped,
+	}
+}
@@ -0,0 +1,198 @@
+package ordering
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+var base = time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+func version(n int) time.Time {
+	return base.Add(time.Duration(n) * time.Second)
+}
+
+var key = Key{SrcSystem: "sys:erp", DataType: "ref:sku", EntityID: "1"}
+
+// accept reserves and commits the version, as the server does for a message
+// that was stored and delivered.
+func accept(t *Tracker, key Key, n int) bool {
+	ok, _ := t.Reserve(key, version(n))
+	if ok {
+		t.Commit(key, version(n))
+	}
+	return ok
+}
+
+func TestModes(t *testing.T) {
+	tests := []struct {
+		mode string
+		want []bool
+	}{
+		{ModeTrack, []bool{true, true, true, true}},
+		{ModeReject, []bool{true, true, false, true}},
+		{ModePark, []bool{true, true, false, true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			tracker := NewTracker(tt.mode, 0, 0)
+			for i, n := range []int{1, 3, 2, 3} {
+				if got := accept(tracker, key, n); got != tt.want[i] {
+					t.Errorf("version %d accepted = %v, want %v", n, got, tt.want[i])
+				}
+			}
+
+			stats := tracker.Stats()
+			stale := 0
+			if tt.mode != ModeTrack {
+				stale = 1
+			}
+			if stats["Reordered"] != 1 || stats["Stale"] != stale {
+				t.Errorf("Stats() = %v", stats)
+			}
+		})
+	}
+}
+
+func TestTrackKeepsLatest(t *testing.T) {
+	tracker := NewTracker(ModeTrack, 0, 0)
+	accept(tracker, key, 3)
+	accept(tracker, key, 1)
+	if _, latest := tracker.Reserve(key, version(4)); !latest.Equal(version(3)) {
+		t.Errorf("latest = %v, want %v", latest, version(3))
+	}
+}
+
+func TestKeys(t *testing.T) {
+	tracker := NewTracker(ModeReject, 0, 0)
+	accept(tracker, key, 2)
+	for _, other := range []Key{
+		{SrcSystem: "sys:crm", DataType: key.DataType, EntityID: key.EntityID},
+		{SrcSystem: key.SrcSystem, DataType: "ref:unit", EntityID: key.EntityID},
+		{SrcSystem: key.SrcSystem, DataType: key.DataType, EntityID: "2"},
+	} {
+		if !accept(tracker, other, 1) {
+			t.Errorf("version of %+v was checked against %+v", other, key)
+		}
+	}
+}
+
+func TestRelease(t *testing.T) {
+	tracker := NewTracker(ModeReject, 0, 0)
+	accept(tracker, key, 1)
+
+	// Version 3 fails to be delivered, so neither its retry nor version 2
+	// are stale.
+	if ok, _ := tracker.Reserve(key, version(3)); !ok {
+		t.Fatal("version 3 rejected")
+	}
+	tracker.Release(key)
+	if !accept(tracker, key, 2) {
+		t.Error("version 2 rejected after version 3 was released")
+	}
+	if !accept(tracker, key, 3) {
+		t.Error("retry of version 3 rejected")
+	}
+	if accept(tracker, key, 2) {
+		t.Error("version 2 accepted after version 3 was committed")
+	}
+}
+
+func TestCommitOutOfOrder(t *testing.T) {
+	tracker := NewTracker(ModeReject, 0, 0)
+	tracker.Reserve(key, version(2))
+	tracker.Reserve(key, version(3))
+	tracker.Commit(key, version(3))
+	tracker.Commit(key, version(2))
+	if _, latest := tracker.Reserve(key, version(4)); !latest.Equal(version(3)) {
+		t.Errorf("latest = %v, want %v", latest, version(3))
+	}
+}
+
+func TestEviction(t *testing.T) {
+	tracker := NewTracker(ModeReject, 2, 0)
+	keys := []Key{{EntityID: "a"}, {EntityID: "b"}, {EntityID: "c"}}
+	accept(tracker, keys[0], 2)
+	// b stays in flight and may not be evicted.
+	tracker.Reserve(keys[1], version(2))
+	accept(tracker, keys[2], 2)
+
+	stats := tracker.Stats()
+	if stats["Entities"] != 2 || stats["Evicted"] != 1 {
+		t.Errorf("Stats() = %v", stats)
+	}
+	if !accept(tracker, keys[0], 1) {
+		t.Error("version of evicted a rejected")
+	}
+	tracker.Commit(keys[1], version(2))
+	if accept(tracker, keys[1], 1) {
+		t.Error("in-flight b was evicted")
+	}
+}
+
+func TestPark(t *testing.T) {
+	tracker := NewTracker(ModePark, 0, 2)
+	for i, verID := range []string{"a", "b", "a", "c"} {
+		tracker.Park(ParkedMessage{Key: key, VerID: verID, Version: version(i)})
+	}
+
+	parked := tracker.Parked()
+	if len(parked) != 2 || parked[0].VerID != "b" || parked[1].VerID != "c" {
+		t.Errorf("Parked() = %+v, want b and c", parked)
+	}
+	if stats := tracker.Stats(); stats["Parked"] != 2 || stats["Dropped"] != 1 {
+		t.Errorf("Stats() = %v", stats)
+	}
+}
+
+func TestConcurrent(t *testing.T) {
+	const (
+		workers  = 8
+		versions = 200
+		entities = 4
+	)
+	tracker := NewTracker(ModeReject, 0, 0)
+
+	var wg sync.WaitGroup
+	accepted := make([][]int, entities)
+	var mutex sync.Mutex
+	for w := range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := w; n < versions; n += workers {
+				key := Key{EntityID: fmt.Sprint(n % entities)}
+				ok, _ := tracker.Reserve(key, version(n))
+				if !ok {
+					continue
+				}
+				mutex.Lock()
+				accepted[n%entities] = append(accepted[n%entities], n)
+				mutex.Unlock()
+				tracker.Commit(key, version(n))
+			}
+		}()
+	}
+	wg.Wait()
+
+	stats := tracker.Stats()
+	total := 0
+	for i, list := range accepted {
+		total += len(list)
+		if len(list) == 0 {
+			t.Errorf("entity %d accepted no version", i)
+			continue
+		}
+		newest := list[0]
+		for _, n := range list {
+			newest = max(newest, n)
+		}
+		if _, latest := tracker.Reserve(Key{EntityID: fmt.Sprint(i)}, version(versions)); !latest.Equal(version(newest)) {
+			t.Errorf("entity %d latest = %v, want %v", i, latest, version(newest))
+		}
+	}
+	if stats["Accepted"] != total || stats["Accepted"].(int)+stats["Stale"].(int) != versions {
+		t.Errorf("Stats() = %v, accepted %d", stats, total)
+	}
+}
@@ -1,51 +1,345 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"flag"
+	"io"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"strconv"
+	"time"
 
+	"stress/balancer"
+	"stress/chaos"
 	. "stress/common"
+	"stress/keys"
+	"stress/limit"
+	"stress/mirror"
 )
 
 type ProxyHandler struct {
-	Proxy  *httputil.ReverseProxy
-	Logger *Logger
+	Proxy     *httputil.ReverseProxy
+	Logger    *Logger
+	Transport http.RoundTripper
+	Chaos     *chaos.Engine
+	Upstreams *balancer.Pool
+	Mirror    *mirror.Mirror
+	Limiter   *limit.Limiter
 }
 
-func NewProxyHandler(destUrl *url.URL, logFile *string) *ProxyHandler {
+type upstreamKey struct{}
+
+func NewProxyHandler(upstreams *balancer.Pool, logFile *string) *ProxyHandler {
 	logger, _ := NewLogger(*logFile)
 	ph := ProxyHandler{
-		Proxy:  httputil.NewSingleHostReverseProxy(destUrl),
-		Logger: logger,
+		Proxy: &httputil.ReverseProxy{
+			Director: func(r *http.Request) {
+				r.Context().Value(upstreamKey{}).(*balancer.Upstream).Director(r)
+			},
+		},
+		Logger:    logger,
+		Transport: http.DefaultTransport,
+		Upstreams: upstreams,
 	}
 	ph.Proxy.Transport = &ph
 	return &ph
 }
 
+func singleHostDirector(u *url.URL) func(*http.Request) {
+	return httputil.NewSingleHostReverseProxy(u).Director
+}
+
 func (t *ProxyHandler) RoundTrip(request *http.Request) (*http.Response, error) {
-	return http.DefaultTransport.RoundTrip(request)
+	resp, err := t.Transport.RoundTrip(request)
+	if upstream, ok := request.Context().Value(upstreamKey{}).(*balancer.Upstream); ok {
+		t.Upstreams.Report(upstream, err == nil && resp.StatusCode < http.StatusInternalServerError)
+	}
+	return resp, err
+}
+
+// forward sends the request to the next upstream of the pool.
+func (h *ProxyHandler) forward(w http.ResponseWriter, r *http.Request) {
+	upstream, err := h.Upstreams.Acquire()
+	if err != nil {
+		h.Logger.Error().Err(err).Msg("No upstream available")
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	defer h.Upstreams.Release(upstream)
+
+	h.Proxy.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), upstreamKey{}, upstream)))
 }
 
 func (h *ProxyHandler) ProxyRequest(w http.ResponseWriter, r *http.Request) {
-	h.Logger.Info().Interface("headers", r.Header).Msgf("> ProxyRequest, Client: %v, %v %v %v\n", r.RemoteAddr, r.Method, r.URL, r.Proto)
-	h.Proxy.ServeHTTP(w, r)
+	h.Logger.Info().Interface("headers", keys.Redact(r.Header)).Msgf("> ProxyRequest, Client: %v, %v %v %v\n", r.RemoteAddr, r.Method, r.URL, r.Proto)
+
+	if h.Limiter != nil {
+		release, err := h.Limiter.Acquire(r.Context(), r.Header.Get("x-esb-src"), r.Header.Get("x-esb-key"))
+		if err != nil {
+			var limitErr *limit.Error
+			if !errors.As(err, &limitErr) {
+				return
+			}
+			h.Logger.Warn().Str("code", limitErr.Code).Str("scope", limitErr.Scope).Msg(limitErr.Message)
+			w.Header().Set("Retry-After", limitErr.RetryAfterSeconds())
+			NewProblem(http.StatusTooManyRequests, limitErr.Code, limitErr.Message).WithHeader(limitErr.Header()).Write(w)
+			return
+		}
+		defer release()
+	}
+
+	completed := false
+	if h.Mirror != nil {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			h.Logger.Error().Err(err).Msg("Failed to read request body")
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		if pending := h.Mirror.Start(r, body); pending != nil {
+			startTime := time.Now()
+			recorder := mirror.NewRecorder(w)
+			// Responses dropped or cut short by chaos abort the handler
+			// and are not compared.
+			defer func() {
+				if completed && recorder.Written() {
+					go pending.Compare(recorder.Result(time.Since(startTime)), h.logMirror(r))
+				}
+			}()
+			w = recorder
+		}
+	}
+
+	if h.Chaos != nil {
+		if faults := h.Chaos.Roll(r); faults.Active() {
+			h.injectFaults(w, r, faults)
+			completed = true
+			return
+		}
+	}
+
+	h.forward(w, r)
+	completed = true
+}
+
+func (h *ProxyHandler) injectFaults(w http.ResponseWriter, r *http.Request, faults *chaos.Faults) {
+	h.Logger.Warn().
+		Strs("rules", faults.Rules).
+		Dur("latency", faults.Latency).
+		Bool("drop", faults.Drop).
+		Int("status", faults.Status).
+		Msg("Injecting faults")
+
+	if faults.Latency > 0 {
+		select {
+		case <-time.After(faults.Latency):
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	if faults.Drop {
+		panic(http.ErrAbortHandler)
+	}
+
+	if faults.Status != 0 {
+		if faults.RetryAfter != "" {
+			w.Header().Set("Retry-After", faults.RetryAfter)
+		}
+		body := http.StatusText(faults.Status)
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		cw := chaos.NewWriter(w, faults)
+		cw.WriteHeader(faults.Status)
+		if _, err := cw.Write([]byte(body)); err != nil {
+			panic(http.ErrAbortHandler)
+		}
+		return
+	}
+
+	h.forward(chaos.NewWriter(w, faults), r)
+}
+
+func (h *ProxyHandler) logMirror(r *http.Request) func(*url.URL, mirror.Result, mirror.Result) {
+	verID := r.Header.Get("x-esb-ver-id")
+	return func(shadow *url.URL, primary, result mirror.Result) {
+		if result.Err != nil {
+			h.Logger.Warn().Str("shadow", shadow.String()).Str("ver_id", verID).Err(result.Err).Msg("Mirror request failed")
+			return
+		}
+
+		event := h.Logger.Info()
+		if result.Status != primary.Status || result.BodyHash != primary.BodyHash {
+			event = h.Logger.Warn()
+		}
+		event.
+			Str("shadow", shadow.String()).
+			Str("ver_id", verID).
+			Int("status", result.Status).
+			Int("primary_status", primary.Status).
+			Bool("body_match", result.BodyHash == primary.BodyHash).
+			Dur("latency", result.Duration).
+			Dur("primary_latency", primary.Duration).
+			Dur("latency_delta", result.Duration-primary.Duration).
+			Msg("Mirror response")
+	}
+}
+
+func (h *ProxyHandler) logStats(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		h.Logger.Info().
+			Interface("Statistics", h.Upstreams.Stats()).
+			Msg("Upstream statistics")
+		if h.Chaos != nil {
+			h.Logger.Info().
+				Interface("Statistics", h.Chaos.Stats()).
+				Msg("Chaos statistics")
+		}
+		if h.Mirror != nil {
+			h.Logger.Info().
+				Interface("Statistics", h.Mirror.Stats()).
+				Msg("Mirror statistics")
+		}
+		if h.Limiter != nil {
+			h.Logger.Info().
+				Interface("Statistics", h.Limiter.Stats()).
+				Msg("Limiter statistics")
+		}
+	}
+}
+
+func (h *ProxyHandler) logHealthChange(u *balancer.Upstream, healthy bool, err error) {
+	if healthy {
+		h.Logger.Info().Str("upstream", u.URL.String()).Msg("Upstream healthy")
+		return
+	}
+	h.Logger.Warn().Str("upstream", u.URL.String()).AnErr("error", err).Msg("Upstream unhealthy")
 }
 
 func main() {
 	svrAddr := flag.String("p", ":8900", "Proxy Server Address")
-	destUrlStr := flag.String("d", "http://dispatch:8950", "destination url")
+	destUrlStr := flag.String("d", "http://dispatch:8950", "destination url, or comma-separated list of destination urls")
+	upstreamsFile := flag.String("upstreams", "", "Path to YAML upstreams configuration, overrides -d")
+	strategy := flag.String("lb", "", "Load balancing strategy: round_robin, least_conn or weighted")
+	healthPath := flag.String("health-path", "", "Path probed on every destination by active health checks")
+	healthInterval := flag.Duration("health-interval", 5*time.Second, "Interval between active health checks")
+	ejectAfter := flag.Int("eject-after", 0, "Eject a destination after this many consecutive failures, 0 to disable")
+	ejectFor := flag.Duration("eject-for", 30*time.Second, "How long an ejected destination receives no traffic")
 	logFile := flag.String("log", "proxy.json", "Path to log file")
-	println("1123123123131")
+	tlsCert := flag.String("tls-cert", "", "Path to TLS certificate, enables HTTPS")
+	tlsKey := flag.String("tls-key", "", "Path to TLS private key")
+	tlsClientCA := flag.String("tls-client-ca", "", "Path to CA of client certificates, enables mutual TLS")
+	upstreamCA := flag.String("upstream-ca", "", "Path to CA of the destination certificate")
+	upstreamCert := flag.String("upstream-cert", "", "Path to client certificate presented to the destination")
+	upstreamKey := flag.String("upstream-key", "", "Path to private key of the client certificate")
+	chaosFile := flag.String("chaos", "", "Path to YAML fault injection rules")
+	mirrors := flag.String("mirror", "", "Comma-separated list of shadow urls, each optionally suffixed with =percent")
+	mirrorPercent := flag.Float64("mirror-percent", 100, "Percentage of requests mirrored to each shadow")
+	mirrorTimeout := flag.Duration("mirror-timeout", 5*time.Second, "Timeout of a mirrored request")
+	mirrorInFlight := flag.Int("mirror-max-in-flight", 100, "Maximum number of mirrored requests in flight, extra ones are skipped")
+	limitsFile := flag.String("limits", "", "Path to YAML rate and concurrency limits")
+	rate := flag.Float64("rate", 0, "Global rate limit in requests per second, 0 to disable")
+	burst := flag.Int("burst", 0, "Burst size of the global rate limit")
+	maxInFlight := flag.Int("max-in-flight", 0, "Maximum number of requests in flight, 0 to disable")
+	limitWait := flag.Duration("limit-wait", 0, "How long a request over the limits waits before it is rejected with 429")
+	upstreamInsecure := flag.Bool("upstream-insecure", false, "Skip verification of the destination certificate")
 	flag.Parse()
 
-	destUrl, _ := url.Parse(*destUrlStr)
-	proxyHandler := NewProxyHandler(destUrl, logFile)
+	lbConfig := balancer.Config{Upstreams: balancer.ParseURLs(*destUrlStr)}
+	if *upstreamsFile != "" {
+		var err error
+		lbConfig, err = balancer.LoadConfig(*upstreamsFile)
+		if err != nil {
+			panic(err)
+		}
+	}
+	if *strategy != "" {
+		lbConfig.Strategy = *strategy
+	}
+	if *healthPath != "" {
+		lbConfig.HealthCheck.Path = *healthPath
+		lbConfig.HealthCheck.Interval = *healthInterval
+	}
+	if *ejectAfter > 0 {
+		lbConfig.Outlier.ConsecutiveFailures = *ejectAfter
+		lbConfig.Outlier.EjectionTime = *ejectFor
+	}
+	upstreams, err := balancer.NewPool(lbConfig, singleHostDirector)
+	if err != nil {
+		panic(err)
+	}
+
+	proxyHandler := NewProxyHandler(upstreams, logFile)
+	go proxyHandler.logStats(5 * time.Second)
+
+	if *upstreamCA != "" || *upstreamCert != "" || *upstreamInsecure {
+		tlsConfig, err := NewClientTLSConfig(*upstreamCA, *upstreamCert, *upstreamKey, *upstreamInsecure)
+		if err != nil {
+			panic(err)
+		}
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = tlsConfig
+		proxyHandler.Transport = transport
+	}
+	upstreams.Transport = proxyHandler.Transport
+	go upstreams.HealthCheck(context.Background(), proxyHandler.logHealthChange)
+
+	if *chaosFile != "" {
+		engine, err := chaos.Load(*chaosFile)
+		if err != nil {
+			panic(err)
+		}
+		proxyHandler.Chaos = engine
+	}
+
+	if *mirrors != "" {
+		proxyHandler.Mirror, err = mirror.New(*mirrors, *mirrorPercent, *mirrorTimeout, *mirrorInFlight)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	var limits limit.Config
+	if *limitsFile != "" {
+		limits, err = limit.LoadConfig(*limitsFile)
+		if err != nil {
+			panic(err)
+		}
+	}
+	if *rate > 0 {
+		limits.Global.Rate = *rate
+		limits.Global.Burst = *burst
+	}
+	if *maxInFlight > 0 {
+		limits.Global.MaxInFlight = *maxInFlight
+	}
+	if *limitWait > 0 {
+		limits.Wait = *limitWait
+	}
+	if *limitsFile != "" || *rate > 0 || *maxInFlight > 0 {
+		proxyHandler.Limiter = limit.NewLimiter(limits)
+	}
 
 	http.HandleFunc("/", proxyHandler.ProxyRequest)
 
-	err := http.ListenAndServe(*svrAddr, nil)
+	if *tlsCert != "" {
+		tlsConfig, tlsErr := NewServerTLSConfig(*tlsCert, *tlsKey, *tlsClientCA)
+		if tlsErr != nil {
+			panic(tlsErr)
+		}
+		server := &http.Server{Addr: *svrAddr, TLSConfig: tlsConfig}
+		err = server.ListenAndServeTLS("", "")
+	} else {
+		err = http.ListenAndServe(*svrAddr, nil)
+	}
 	if err != nil {
 		panic(err)
 	}
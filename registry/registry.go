@@ -0,0 +1,170 @@
+package registry
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math/rand"
+	"os"
+
+	"gopkg.in/yaml.v3"
+)
+
+type System struct {
+	SystemID    string `yaml:"system_id"`
+	Description string `yaml:"description"`
+	Addr        string `yaml:"addr"`
+	Resource    string `yaml:"resource"`
+	Active      bool   `yaml:"active"`
+}
+
+type DataType struct {
+	DataType    string `yaml:"data_type"`
+	Description string `yaml:"description"`
+}
+
+type Error struct {
+	Code    string
+	Message string
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+const (
+	CodeUnknownSource   = "unknown_source"
+	CodeInactiveSource  = "inactive_source"
+	CodeUnknownDataType = "unknown_data_type"
+)
+
+// Registry is the set of known systems and data types, as in the systems
+// and data_types tables.
+type Registry struct {
+	Systems   []System   `yaml:"systems"`
+	DataTypes []DataType `yaml:"data_types"`
+	systems   map[string]*System
+	dataTypes map[string]*DataType
+}
+
+func LoadFile(path string) (*Registry, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read registry file: %w", err)
+	}
+
+	r := &Registry{}
+	if err := yaml.Unmarshal(data, r); err != nil {
+		return nil, fmt.Errorf("failed to parse registry file: %w", err)
+	}
+	r.index()
+	return r, nil
+}
+
+func LoadDB(ctx context.Context, db *sql.DB) (*Registry, error) {
+	r := &Registry{}
+
+	rows, err := db.QueryContext(ctx, `select system_id, coalesce(description, ''), coalesce(addr, ''), coalesce(resource, ''), active from systems`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load systems: %w", err)
+	}
+	for rows.Next() {
+		var s System
+		if err := rows.Scan(&s.SystemID, &s.Description, &s.Addr, &s.Resource, &s.Active); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to read system: %w", err)
+		}
+		r.Systems = append(r.Systems, s)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to load systems: %w", err)
+	}
+
+	rows, err = db.QueryContext(ctx, `select data_type, coalesce(data_type_description, '') from data_types`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load data types: %w", err)
+	}
+	for rows.Next() {
+		var d DataType
+		if err := rows.Scan(&d.DataType, &d.Description); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to read data type: %w", err)
+		}
+		r.DataTypes = append(r.DataTypes, d)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to load data types: %w", err)
+	}
+
+	r.index()
+	return r, nil
+}
+
+func (r *Registry) index() {
+	r.systems = make(map[string]*System, len(r.Systems))
+	for i := range r.Systems {
+		r.systems[r.Systems[i].SystemID] = &r.Systems[i]
+	}
+	r.dataTypes = make(map[string]*DataType, len(r.DataTypes))
+	for i := range r.DataTypes {
+		r.dataTypes[r.DataTypes[i].DataType] = &r.DataTypes[i]
+	}
+}
+
+func (r *Registry) CheckSource(systemID string) error {
+	s, ok := r.systems[systemID]
+	if !ok {
+		return &Error{Code: CodeUnknownSource, Message: fmt.Sprintf("unknown source system %q", systemID)}
+	}
+	if !s.Active {
+		return &Error{Code: CodeInactiveSource, Message: fmt.Sprintf("source system %q is not active", systemID)}
+	}
+	return nil
+}
+
+func (r *Registry) CheckDataType(dataType string) error {
+	if _, ok := r.dataTypes[dataType]; !ok {
+		return &Error{Code: CodeUnknownDataType, Message: fmt.Sprintf("unregistered data type %q", dataType)}
+	}
+	return nil
+}
+
+// ActiveSystems returns the systems that may send messages.
+func (r *Registry) ActiveSystems() []System {
+	var active []System
+	for _, s := range r.Systems {
+		if s.Active {
+			active = append(active, s)
+		}
+	}
+	return active
+}
+
+// Senders returns the active systems with a key of their own, the ones a
+// client can send as.
+func (r *Registry) Senders() []System {
+	var senders []System
+	for _, s := range r.ActiveSystems() {
+		if s.Addr != "" {
+			senders = append(senders, s)
+		}
+	}
+	return senders
+}
+
+func (r *Registry) RandomSender() (System, bool) {
+	senders := r.Senders()
+	if len(senders) == 0 {
+		return System{}, false
+	}
+	return senders[rand.Intn(len(senders))], true
+}
+
+func (r *Registry) RandomDataType() (DataType, bool) {
+	if len(r.DataTypes) == 0 {
+		return DataType{}, false
+	}
+	return r.DataTypes[rand.Intn(len(r.DataTypes))], true
+}
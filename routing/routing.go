@@ -0,0 +1,209 @@
+package routing
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"slices"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Binding mirrors a row of the bindings table. Every field is a LIKE prefix:
+// an empty value matches anything.
+type Binding struct {
+	RouteID   int    `yaml:"route_id"`
+	DataType  string `yaml:"data_type"`
+	SrcSystem string `yaml:"src_system"`
+	DstSystem string `yaml:"dst_system"`
+}
+
+type SystemMapping struct {
+	SystemID string `yaml:"system_id"`
+	Alias    string `yaml:"alias"`
+}
+
+type Channel struct {
+	Channel     string `yaml:"channel"`
+	SystemID    string `yaml:"system_id"`
+	EnableRoute bool   `yaml:"enable_route"`
+}
+
+type Table struct {
+	Bindings       []Binding       `yaml:"bindings"`
+	SystemsMapping []SystemMapping `yaml:"systems_mapping"`
+	Channels       []Channel       `yaml:"channels"`
+}
+
+type Message struct {
+	SrcSystem string
+	DstSystem string
+	DataType  string
+}
+
+func LoadFile(path string) (*Table, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read routing file: %w", err)
+	}
+
+	table := &Table{}
+	if err := yaml.Unmarshal(data, table); err != nil {
+		return nil, fmt.Errorf("failed to parse routing file: %w", err)
+	}
+	return table, nil
+}
+
+func LoadDB(ctx context.Context, db *sql.DB) (*Table, error) {
+	table := &Table{}
+
+	err := queryRows(ctx, db, `select route_id, data_type, src_system, dst_system from bindings`, func(rows *sql.Rows) error {
+		var b Binding
+		if err := rows.Scan(&b.RouteID, &b.DataType, &b.SrcSystem, &b.DstSystem); err != nil {
+			return err
+		}
+		table.Bindings = append(table.Bindings, b)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to load bindings: %w", err)
+	}
+
+	err = queryRows(ctx, db, `select system_id, alias from systems_mapping`, func(rows *sql.Rows) error {
+		var m SystemMapping
+		if err := rows.Scan(&m.SystemID, &m.Alias); err != nil {
+			return err
+		}
+		table.SystemsMapping = append(table.SystemsMapping, m)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to load systems mapping: %w", err)
+	}
+
+	err = queryRows(ctx, db, `select channel, coalesce(system_id, ''), coalesce(enable_route, false) from channels`, func(rows *sql.Rows) error {
+		var c Channel
+		if err := rows.Scan(&c.Channel, &c.SystemID, &c.EnableRoute); err != nil {
+			return err
+		}
+		table.Channels = append(table.Channels, c)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to load channels: %w", err)
+	}
+
+	return table, nil
+}
+
+func queryRows(ctx context.Context, db *sql.DB, query string, scan func(rows *sql.Rows) error) error {
+	rows, err := db.QueryContext(ctx, query)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		if err := scan(rows); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// Subscribers is the in-memory equivalent of the subscribers(id) SQL function.
+// When the message names a destination, the destination is resolved through
+// systems_mapping and only the mapped systems are considered; otherwise every
+// channel whose system matches a binding receives the message.
+func (t *Table) Subscribers(msg Message) []string {
+	var systems []string
+	if msg.DstSystem != "" {
+		for _, m := range t.SystemsMapping {
+			if m.Alias == msg.DstSystem {
+				systems = append(systems, m.SystemID)
+			}
+		}
+	}
+
+	var channels []string
+	for _, b := range t.Bindings {
+		if !Like(msg.DataType, b.DataType+"%") || !Like(msg.SrcSystem, b.SrcSystem+"%") {
+			continue
+		}
+		for _, c := range t.Channels {
+			if !c.EnableRoute {
+				continue
+			}
+			if msg.DstSystem == "" {
+				if Like(c.SystemID, b.DstSystem+"%") {
+					channels = append(channels, c.Channel)
+				}
+				continue
+			}
+			for _, system := range systems {
+				if c.SystemID == system && Like(system, b.DstSystem+"%") {
+					channels = append(channels, c.Channel)
+				}
+			}
+		}
+	}
+
+	slices.Sort(channels)
+	return slices.Compact(channels)
+}
+
+// Like reports whether s matches the SQL LIKE pattern, using PostgreSQL rules:
+// '%' matches any sequence, '_' matches one character, '\' escapes the next one.
+func Like(s, pattern string) bool {
+	str := []rune(s)
+	pat := []rune(pattern)
+
+	var match func(i, j int) bool
+	match = func(i, j int) bool {
+		for j < len(pat) {
+			switch pat[j] {
+			case '%':
+				for j < len(pat) && pat[j] == '%' {
+					j++
+				}
+				if j == len(pat) {
+					return true
+				}
+				for k := i; k <= len(str); k++ {
+					if match(k, j) {
+						return true
+					}
+				}
+				return false
+			case '_':
+				if i == len(str) {
+					return false
+				}
+			case '\\':
+				if j+1 < len(pat) {
+					j++
+				}
+				fallthrough
+			default:
+				if i == len(str) || str[i] != pat[j] {
+					return false
+				}
+			}
+			i++
+			j++
+		}
+		return i == len(str)
+	}
+
+	return match(0, 0)
+}
+
+func (t *Table) ChannelSystem(channel string) string {
+	for _, c := range t.Channels {
+		if c.Channel == channel {
+			return c.SystemID
+		}
+	}
+	return ""
+}
@@ -0,0 +1,167 @@
+package routing
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestLike(t *testing.T) {
+	tests := []struct {
+		s, pattern string
+		want       bool
+	}{
+		{"ref:sku", "ref:sku", true},
+		{"ref:sku", "ref:%", true},
+		{"ref:sku", "%", true},
+		{"", "%", true},
+		{"", "", true},
+		{"ref:sku", "", false},
+		{"ref:sku", "ref:", false},
+		{"ref:sku", "%sku", true},
+		{"ref:sku", "%s%u", true},
+		{"ref:sku", "ref:s_u", true},
+		{"ref:sku", "ref:s_", false},
+		{"ref:sku", "ref:s__", true},
+		{"ref:sku", "ref:s___", false},
+		{"ref", "%%%", true},
+		{"100%", `100\%`, true},
+		{"1000", `100\%`, false},
+		{"a_b", `a\_b`, true},
+		{"axb", `a\_b`, false},
+		{`a\b`, `a\\b`, true},
+		{"ref:sku", "REF:%", false},
+		{"справочник", "справ_чник", true},
+	}
+	for _, tt := range tests {
+		if got := Like(tt.s, tt.pattern); got != tt.want {
+			t.Errorf("Like(%q, %q) = %v, want %v", tt.s, tt.pattern, got, tt.want)
+		}
+	}
+}
+
+// table mirrors rows that would be in bindings, systems_mapping and channels
+// for the subscribers() function in postgres/esb_1.sql.
+var table = &Table{
+	Bindings: []Binding{
+		{RouteID: 1, DataType: "ref:sku", SrcSystem: "sys:erp", DstSystem: "sys:wms"},
+		{RouteID: 2, DataType: "ref:", SrcSystem: "sys:erp", DstSystem: "sys:crm"},
+		{RouteID: 3, DataType: "doc:order", SrcSystem: "", DstSystem: ""},
+		{RouteID: 4, DataType: "doc:_nvoice", SrcSystem: "sys:", DstSystem: "sys:b"},
+		{RouteID: 5, DataType: `doc:100\%`, SrcSystem: "sys:erp", DstSystem: "sys:wms"},
+		{RouteID: 6, DataType: "ref:sku", SrcSystem: "sys:", DstSystem: "sys:wms"},
+	},
+	SystemsMapping: []SystemMapping{
+		{SystemID: "sys:wms", Alias: "warehouse"},
+		{SystemID: "sys:wms2", Alias: "warehouse"},
+		{SystemID: "sys:crm", Alias: "crm"},
+		{SystemID: "sys:bi", Alias: "analytics"},
+		{SystemID: "sys:bank", Alias: "bank"},
+	},
+	Channels: []Channel{
+		{Channel: "wms", SystemID: "sys:wms", EnableRoute: true},
+		{Channel: "wms-backup", SystemID: "sys:wms", EnableRoute: true},
+		{Channel: "wms2", SystemID: "sys:wms2", EnableRoute: true},
+		{Channel: "crm", SystemID: "sys:crm", EnableRoute: true},
+		{Channel: "bi", SystemID: "sys:bi", EnableRoute: true},
+		{Channel: "bank", SystemID: "sys:bank", EnableRoute: false},
+	},
+}
+
+func TestSubscribers(t *testing.T) {
+	tests := []struct {
+		name string
+		msg  Message
+		want []string
+	}{
+		{
+			// dst_system = '': every enabled channel whose system matches the binding.
+			name: "empty dst",
+			msg:  Message{SrcSystem: "sys:erp", DataType: "ref:sku"},
+			// Routes 1 and 6 both lead to the sys:wms channels and route 6
+			// matches sys:wms2 as well; route 2 adds crm.
+			want: []string{"crm", "wms", "wms-backup", "wms2"},
+		},
+		{
+			name: "empty dst, data type prefix",
+			msg:  Message{SrcSystem: "sys:erp", DataType: "ref:unit"},
+			want: []string{"crm"},
+		},
+		{
+			name: "empty dst, any source and destination",
+			msg:  Message{SrcSystem: "sys:anything", DataType: "doc:order"},
+			want: []string{"bi", "crm", "wms", "wms-backup", "wms2"},
+		},
+		{
+			// sys:bank matches route 4 but its channel has enable_route = false.
+			name: "empty dst, disabled channel",
+			msg:  Message{SrcSystem: "sys:erp", DataType: "doc:invoice"},
+			want: []string{"bi"},
+		},
+		{
+			name: "underscore matches one character",
+			msg:  Message{SrcSystem: "sys:erp", DataType: "doc:xnvoice"},
+			want: []string{"bi"},
+		},
+		{
+			name: "underscore does not match none",
+			msg:  Message{SrcSystem: "sys:erp", DataType: "doc:nvoice"},
+			want: nil,
+		},
+		{
+			name: "escaped percent is literal",
+			msg:  Message{SrcSystem: "sys:erp", DataType: "doc:100%"},
+			want: []string{"wms", "wms-backup", "wms2"},
+		},
+		{
+			name: "escaped percent is not a wildcard",
+			msg:  Message{SrcSystem: "sys:erp", DataType: "doc:1000"},
+			want: nil,
+		},
+		{
+			// dst_system <> '': only the systems mapped from the alias.
+			name: "dst through systems_mapping",
+			msg:  Message{SrcSystem: "sys:erp", DstSystem: "warehouse", DataType: "ref:sku"},
+			want: []string{"wms", "wms-backup", "wms2"},
+		},
+		{
+			name: "dst mapped system outside of the bindings",
+			msg:  Message{SrcSystem: "sys:erp", DstSystem: "analytics", DataType: "ref:sku"},
+			want: nil,
+		},
+		{
+			name: "dst alias narrows the bindings",
+			msg:  Message{SrcSystem: "sys:erp", DstSystem: "crm", DataType: "ref:sku"},
+			want: []string{"crm"},
+		},
+		{
+			name: "dst without mapping",
+			msg:  Message{SrcSystem: "sys:erp", DstSystem: "sys:wms", DataType: "ref:sku"},
+			want: nil,
+		},
+		{
+			name: "dst to a disabled channel",
+			msg:  Message{SrcSystem: "sys:erp", DstSystem: "bank", DataType: "doc:invoice"},
+			want: nil,
+		},
+		{
+			name: "no binding",
+			msg:  Message{SrcSystem: "sys:erp", DataType: "cat:item"},
+			want: nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := table.Subscribers(tt.msg)
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("Subscribers(%+v) = %v, want %v", tt.msg, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSubscribersDistinct(t *testing.T) {
+	got := table.Subscribers(Message{SrcSystem: "sys:erp", DataType: "ref:sku"})
+	if !slices.Equal(got, slices.Compact(slices.Clone(got))) {
+		t.Errorf("Subscribers returned duplicates: %v", got)
+	}
+}
@@ -0,0 +1,220 @@
+package rules
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	TypeString    = "string"
+	TypeUUID      = "uuid"
+	TypeTimestamp = "timestamp"
+	TypeEnum      = "enum"
+	TypeRegex     = "regex"
+)
+
+const (
+	CodeMissing   = "missing_header"
+	CodeInvalid   = "invalid_header"
+	CodeDuplicate = "duplicate_header"
+)
+
+const invalidValue = "invalid-value"
+
+// Rule describes one request header. Auth rules only apply when request
+// authentication is enabled. Regex patterns must match the whole value.
+type Rule struct {
+	Header          string   `yaml:"header"`
+	Type            string   `yaml:"type"`
+	Layout          string   `yaml:"layout"`
+	Values          []string `yaml:"values"`
+	Pattern         string   `yaml:"pattern"`
+	MinLength       int      `yaml:"min_length"`
+	MaxLength       int      `yaml:"max_length"`
+	Required        bool     `yaml:"required"`
+	AllowDuplicates bool     `yaml:"allow_duplicates"`
+	Auth            bool     `yaml:"auth"`
+	Status          int      `yaml:"status"`
+	Examples        []string `yaml:"examples"`
+	pattern         *regexp.Regexp
+}
+
+type RuleSet struct {
+	Rules []*Rule `yaml:"rules"`
+}
+
+type Violation struct {
+	Header  string
+	Code    string
+	Status  int
+	Message string
+}
+
+func Load(path string) (*RuleSet, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read rules file: %w", err)
+	}
+
+	rs := &RuleSet{}
+	if err := yaml.Unmarshal(data, rs); err != nil {
+		return nil, fmt.Errorf("failed to parse rules file: %w", err)
+	}
+	if err := rs.compile(); err != nil {
+		return nil, err
+	}
+	return rs, nil
+}
+
+// Default returns the rules the server has always applied: x-esb-src,
+// x-esb-data-type and x-esb-key are required, x-esb-ver-id is a UUID and
+// x-esb-ver-no is a timestamp.
+func Default() *RuleSet {
+	rs := &RuleSet{Rules: []*Rule{
+		{Header: "x-esb-src", Type: TypeString, Required: true},
+		{Header: "x-esb-data-type", Type: TypeString, Required: true},
+		{Header: "x-esb-ver-id", Type: TypeUUID},
+		{Header: "x-esb-ver-no", Type: TypeTimestamp, Layout: "20060102T150405"},
+		{Header: "x-esb-key", Type: TypeString, Required: true, Auth: true},
+	}}
+	rs.compile()
+	return rs
+}
+
+func (rs *RuleSet) compile() error {
+	for _, rule := range rs.Rules {
+		if rule.Header == "" {
+			return fmt.Errorf("rule without header name")
+		}
+		if rule.Type == "" {
+			rule.Type = TypeString
+		}
+		if rule.Status == 0 {
+			rule.Status = http.StatusBadRequest
+		}
+		switch rule.Type {
+		case TypeString, TypeUUID, TypeEnum:
+		case TypeTimestamp:
+			if rule.Layout == "" {
+				return fmt.Errorf("rule for %s: timestamp without layout", rule.Header)
+			}
+		case TypeRegex:
+			re, err := regexp.Compile("^(?:" + rule.Pattern + ")$")
+			if err != nil {
+				return fmt.Errorf("rule for %s: %w", rule.Header, err)
+			}
+			rule.pattern = re
+		default:
+			return fmt.Errorf("rule for %s: unknown type %q", rule.Header, rule.Type)
+		}
+	}
+	return nil
+}
+
+// Validate returns the first violated rule, or nil if the headers satisfy
+// every rule.
+func (rs *RuleSet) Validate(headers http.Header, authenticate bool) *Violation {
+	for _, rule := range rs.Rules {
+		if rule.Auth && !authenticate {
+			continue
+		}
+
+		values := headers.Values(rule.Header)
+		if len(values) == 0 || (len(values) == 1 && values[0] == "") {
+			if rule.Required {
+				return &Violation{Header: rule.Header, Code: CodeMissing, Status: rule.Status, Message: "Missing required header"}
+			}
+			continue
+		}
+		if len(values) > 1 && !rule.AllowDuplicates {
+			return &Violation{Header: rule.Header, Code: CodeDuplicate, Status: rule.Status, Message: "Duplicate header"}
+		}
+		for _, value := range values {
+			if err := rule.Check(value); err != nil {
+				return &Violation{Header: rule.Header, Code: CodeInvalid, Status: rule.Status, Message: err.Error()}
+			}
+		}
+	}
+	return nil
+}
+
+func (r *Rule) Check(value string) error {
+	length := len([]rune(value))
+	if r.MinLength > 0 && length < r.MinLength {
+		return fmt.Errorf("value is shorter than %d", r.MinLength)
+	}
+	if r.MaxLength > 0 && length > r.MaxLength {
+		return fmt.Errorf("value is longer than %d", r.MaxLength)
+	}
+
+	switch r.Type {
+	case TypeUUID:
+		if err := uuid.Validate(value); err != nil {
+			return fmt.Errorf("value is not a UUID")
+		}
+	case TypeTimestamp:
+		if _, err := time.Parse(r.Layout, value); err != nil {
+			return fmt.Errorf("value does not match layout %s", r.Layout)
+		}
+	case TypeEnum:
+		if !slices.Contains(r.Values, value) {
+			return fmt.Errorf("value is not one of %s", strings.Join(r.Values, ", "))
+		}
+	case TypeRegex:
+		if !r.pattern.MatchString(value) {
+			return fmt.Errorf("value does not match %s", r.Pattern)
+		}
+	}
+	return nil
+}
+
+// Generate returns a value satisfying the rule, falling back to the given
+// value for free-form types without examples.
+func (r *Rule) Generate(fallback string) string {
+	switch r.Type {
+	case TypeUUID:
+		return uuid.New().String()
+	case TypeTimestamp:
+		return time.Now().Format(r.Layout)
+	case TypeEnum:
+		if len(r.Values) > 0 {
+			return r.Values[rand.Intn(len(r.Values))]
+		}
+	}
+	if len(r.Examples) > 0 {
+		return r.Examples[rand.Intn(len(r.Examples))]
+	}
+	return fallback
+}
+
+// GenerateInvalid returns a value violating the rule where the rule makes
+// that possible.
+func (r *Rule) GenerateInvalid() string {
+	if r.MaxLength > 0 && (rand.Intn(2) == 0 || r.Check(invalidValue) == nil) {
+		return strings.Repeat("x", r.MaxLength+1)
+	}
+	return invalidValue
+}
+
+// Violates reports whether the headers generated for a rule would be
+// rejected by it.
+func (r *Rule) Violates(values []string) bool {
+	if len(values) > 1 && !r.AllowDuplicates {
+		return true
+	}
+	for _, value := range values {
+		if r.Check(value) != nil {
+			return true
+		}
+	}
+	return false
+}
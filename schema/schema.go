@@ -0,0 +1,259 @@
+// Package schema validates message bodies against the XML and JSON schemas
+// of their data types.
+//
+// JSON schemas are compiled by jsonschema, with formats asserted. XML schemas
+// are checked by a validator of its own, which understands this subset of
+// XSD:
+//
+//   - global and local element and attribute declarations, and references
+//     to them;
+//   - named and anonymous complexType and simpleType;
+//   - sequence, choice, all and any particles with minOccurs and maxOccurs,
+//     group and attributeGroup definitions and references, anyAttribute;
+//   - complexContent extension and restriction, simpleContent extension and
+//     restriction, mixed content;
+//   - simpleType restriction with the enumeration, pattern, length,
+//     minLength, maxLength and min/max inclusive/exclusive facets, list and
+//     union;
+//   - include and import of local files;
+//   - the numeric, boolean, date and time, duration and binary built-in
+//     types; the other string-like built-in types are checked as strings.
+//
+// Namespaces are not checked, names are compared by their local part. A
+// schema using any other construct, such as identity constraints,
+// substitution groups, fixed values or the whiteSpace, totalDigits and
+// fractionDigits facets, or referring to an undefined type or declaration,
+// fails to load.
+package schema
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/santhosh-tekuri/jsonschema/v5"
+	"gopkg.in/yaml.v3"
+)
+
+type Error struct {
+	Path    string `json:"path"`
+	Message string `json:"message"`
+}
+
+type typeStats struct {
+	validated int
+	rejected  int
+}
+
+// Registry holds the schemas of a schema directory. A data type is looked up
+// by its name with ':' and '/' replaced by '_', e.g. ref:sku -> ref_sku.json
+// and ref_sku.xsd. The optional nested.yaml lists, per data type, the types it
+// inherits, like the nested_schemes table: an XML schema sees the global
+// declarations of the inherited schemas, and a JSON document must also be
+// valid against every inherited JSON schema.
+type Registry struct {
+	json   map[string]*jsonschema.Schema
+	xml    map[string]*xsdSchema
+	nested map[string][]string
+	stats  map[string]*typeStats
+	mutex  sync.Mutex
+}
+
+func FileName(dataType string) string {
+	return strings.NewReplacer(":", "_", "/", "_").Replace(dataType)
+}
+
+func Load(dir string) (*Registry, error) {
+	r := &Registry{
+		json:   make(map[string]*jsonschema.Schema),
+		xml:    make(map[string]*xsdSchema),
+		nested: make(map[string][]string),
+		stats:  make(map[string]*typeStats),
+	}
+
+	if data, err := os.ReadFile(filepath.Join(dir, "nested.yaml")); err == nil {
+		if err := yaml.Unmarshal(data, &r.nested); err != nil {
+			return nil, fmt.Errorf("failed to parse nested schemes: %w", err)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read nested schemes: %w", err)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read schema directory: %w", err)
+	}
+
+	compiler := jsonschema.NewCompiler()
+	// Formats such as date-time are only annotations unless asserted, and XML
+	// bodies have their dates checked, so JSON ones do as well.
+	compiler.AssertFormat = true
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		path := filepath.Join(dir, entry.Name())
+		name := strings.TrimSuffix(entry.Name(), filepath.Ext(entry.Name()))
+
+		switch filepath.Ext(entry.Name()) {
+		case ".json":
+			s, err := compiler.Compile(path)
+			if err != nil {
+				return nil, fmt.Errorf("failed to compile %s: %w", entry.Name(), err)
+			}
+			r.json[name] = s
+		case ".xsd":
+			s, err := parseXsd(path)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse %s: %w", entry.Name(), err)
+			}
+			r.xml[name] = s
+		}
+	}
+
+	for name, s := range r.xml {
+		for _, inherited := range r.inherited(name) {
+			if parent, ok := r.xml[FileName(inherited)]; ok {
+				s.inherit(parent)
+			}
+		}
+	}
+	for name, s := range r.xml {
+		if err := s.resolve(); err != nil {
+			return nil, fmt.Errorf("failed to parse %s.xsd: %w", name, err)
+		}
+	}
+
+	return r, nil
+}
+
+// inherited returns the transitive list of types the data type inherits.
+func (r *Registry) inherited(name string) []string {
+	var result []string
+	seen := map[string]bool{name: true}
+	queue := []string{name}
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
+		for dataType, parents := range r.nested {
+			if FileName(dataType) != current {
+				continue
+			}
+			for _, parent := range parents {
+				if !seen[FileName(parent)] {
+					seen[FileName(parent)] = true
+					result = append(result, parent)
+					queue = append(queue, FileName(parent))
+				}
+			}
+		}
+	}
+	return result
+}
+
+// Validate checks the body against the schema of the data type. The second
+// result is false when there is no schema for the data type at all.
+func (r *Registry) Validate(dataType string, body []byte) ([]Error, bool) {
+	name := FileName(dataType)
+	jsonSchema, hasJson := r.json[name]
+	xmlSchema, hasXml := r.xml[name]
+	if !hasJson && !hasXml {
+		return nil, false
+	}
+
+	var errs []Error
+	trimmed := bytes.TrimSpace(body)
+	switch {
+	case bytes.HasPrefix(trimmed, []byte("<")):
+		if !hasXml {
+			errs = []Error{{Path: "/", Message: "no XML schema for data type " + dataType}}
+		} else {
+			errs = xmlSchema.validate(trimmed)
+		}
+	default:
+		if !hasJson {
+			errs = []Error{{Path: "/", Message: "no JSON schema for data type " + dataType}}
+		} else {
+			errs = r.validateJson(name, jsonSchema, trimmed)
+		}
+	}
+
+	r.record(dataType, len(errs) == 0)
+	return errs, true
+}
+
+func (r *Registry) validateJson(name string, s *jsonschema.Schema, body []byte) []Error {
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	var doc interface{}
+	if err := decoder.Decode(&doc); err != nil {
+		return []Error{{Path: "/", Message: err.Error()}}
+	}
+
+	schemas := []*jsonschema.Schema{s}
+	for _, inherited := range r.inherited(name) {
+		if parent, ok := r.json[FileName(inherited)]; ok {
+			schemas = append(schemas, parent)
+		}
+	}
+
+	var errs []Error
+	for _, s := range schemas {
+		err := s.Validate(doc)
+		if ve, ok := err.(*jsonschema.ValidationError); ok {
+			errs = append(errs, leafErrors(ve)...)
+		} else if err != nil {
+			errs = append(errs, Error{Path: "/", Message: err.Error()})
+		}
+	}
+	return errs
+}
+
+func leafErrors(ve *jsonschema.ValidationError) []Error {
+	if len(ve.Causes) == 0 {
+		path := ve.InstanceLocation
+		if path == "" {
+			path = "/"
+		}
+		return []Error{{Path: path, Message: ve.Message}}
+	}
+
+	var errs []Error
+	for _, cause := range ve.Causes {
+		errs = append(errs, leafErrors(cause)...)
+	}
+	return errs
+}
+
+func (r *Registry) record(dataType string, valid bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	stats, ok := r.stats[dataType]
+	if !ok {
+		stats = &typeStats{}
+		r.stats[dataType] = stats
+	}
+	stats.validated++
+	if !valid {
+		stats.rejected++
+	}
+}
+
+func (r *Registry) Stats() map[string]interface{} {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	result := make(map[string]interface{}, len(r.stats))
+	for dataType, stats := range r.stats {
+		result[dataType] = map[string]int{
+			"Validated": stats.validated,
+			"Rejected":  stats.rejected,
+		}
+	}
+	return result
+}
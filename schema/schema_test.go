@@ -0,0 +1,411 @@
+package schema
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func loadFixtures(t *testing.T) *Registry {
+	t.Helper()
+	r, err := Load("../schemas")
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	return r
+}
+
+// writeSchemas creates a schema directory with the files.
+func writeSchemas(t *testing.T, files map[string]string) *Registry {
+	t.Helper()
+	dir := t.TempDir()
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r, err := Load(dir)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	return r
+}
+
+type validateCase struct {
+	name     string
+	dataType string
+	body     string
+	// paths of the expected errors; none for a valid body
+	paths []string
+}
+
+func runValidate(t *testing.T, r *Registry, tests []validateCase) {
+	t.Helper()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			errs, known := r.Validate(tt.dataType, []byte(tt.body))
+			if !known {
+				t.Fatalf("Validate(%s) reports no schema", tt.dataType)
+			}
+			var paths []string
+			for _, e := range errs {
+				if e.Message == "" {
+					t.Errorf("error at %s has no message", e.Path)
+				}
+				paths = append(paths, e.Path)
+			}
+			slices.Sort(paths)
+			want := slices.Clone(tt.paths)
+			slices.Sort(want)
+			if !slices.Equal(paths, want) {
+				t.Errorf("Validate(%s) errors = %+v, want paths %v", tt.dataType, errs, tt.paths)
+			}
+		})
+	}
+}
+
+func TestValidateFixtures(t *testing.T) {
+	runValidate(t, loadFixtures(t), []validateCase{
+		{
+			name:     "sku xml",
+			dataType: "ref:sku",
+			body:     `<sku><id>1</id><timestamp>2024-01-02T03:04:05Z</timestamp><payload>abc</payload></sku>`,
+		},
+		{
+			name:     "sku xml with declaration and whitespace",
+			dataType: "ref:sku",
+			body: `
+<?xml version="1.0" encoding="UTF-8"?>
+<sku>
+  <id>1</id>
+  <timestamp>2024-01-02T03:04:05</timestamp>
+  <payload/>
+</sku>`,
+		},
+		{
+			name:     "sku xml missing inherited element",
+			dataType: "ref:sku",
+			body:     `<sku><timestamp>2024-01-02T03:04:05Z</timestamp><payload>abc</payload></sku>`,
+			paths:    []string{"/sku/id"},
+		},
+		{
+			name:     "sku xml invalid inherited type",
+			dataType: "ref:sku",
+			body:     `<sku><id>1</id><timestamp>yesterday</timestamp><payload>abc</payload></sku>`,
+			paths:    []string{"/sku/timestamp"},
+		},
+		{
+			name:     "sku xml elements out of order",
+			dataType: "ref:sku",
+			body:     `<sku><id>1</id><payload>abc</payload><timestamp>2024-01-02T03:04:05Z</timestamp></sku>`,
+			paths:    []string{"/sku/timestamp", "/sku/timestamp"},
+		},
+		{
+			name:     "sku xml undeclared element",
+			dataType: "ref:sku",
+			body:     `<sku><id>1</id><timestamp>2024-01-02T03:04:05Z</timestamp><payload>abc</payload><extra/></sku>`,
+			paths:    []string{"/sku/extra"},
+		},
+		{
+			name:     "sku xml undeclared attribute",
+			dataType: "ref:sku",
+			body:     `<sku version="2"><id>1</id><timestamp>2024-01-02T03:04:05Z</timestamp><payload>abc</payload></sku>`,
+			paths:    []string{"/sku/@version"},
+		},
+		{
+			name:     "sku xml unknown root",
+			dataType: "ref:sku",
+			body:     `<item/>`,
+			paths:    []string{"/item"},
+		},
+		{
+			name:     "sku xml malformed",
+			dataType: "ref:sku",
+			body:     `<sku><id>1</sku>`,
+			paths:    []string{"/"},
+		},
+		{
+			name:     "sku json",
+			dataType: "ref:sku",
+			body:     `{"id": "1", "timestamp": "2024-01-02T03:04:05Z", "payload": "abc"}`,
+		},
+		{
+			name:     "sku json missing own property",
+			dataType: "ref:sku",
+			body:     `{"id": "1", "timestamp": "2024-01-02T03:04:05Z"}`,
+			paths:    []string{"/"},
+		},
+		{
+			name:     "sku json missing inherited properties",
+			dataType: "ref:sku",
+			body:     `{"payload": "abc"}`,
+			paths:    []string{"/"},
+		},
+		{
+			name:     "sku json wrong types",
+			dataType: "ref:sku",
+			body:     `{"id": "", "timestamp": "2024-01-02T03:04:05Z", "payload": 5}`,
+			paths:    []string{"/id", "/payload"},
+		},
+		{
+			name:     "sku json timestamp not a date-time",
+			dataType: "ref:sku",
+			body:     `{"id": "1", "timestamp": "yesterday", "payload": "abc"}`,
+			paths:    []string{"/timestamp"},
+		},
+		{
+			name:     "sku json malformed",
+			dataType: "ref:sku",
+			body:     `{"id": `,
+			paths:    []string{"/"},
+		},
+		{
+			name:     "base json",
+			dataType: "ref:base",
+			body:     `{"id": "1", "timestamp": "2024-01-02T03:04:05Z"}`,
+		},
+		{
+			name:     "base json does not inherit sku",
+			dataType: "ref:base",
+			body:     `{"id": "1", "timestamp": "2024-01-02T03:04:05Z", "payload": 5}`,
+		},
+		{
+			name:     "base json invalid",
+			dataType: "ref:base",
+			body:     `{"id": 1}`,
+			paths:    []string{"/", "/id"},
+		},
+		{
+			name:     "base xml without global element",
+			dataType: "ref:base",
+			body:     `<Reference><id>1</id></Reference>`,
+			paths:    []string{"/Reference"},
+		},
+	})
+}
+
+func TestValidateUnknownDataType(t *testing.T) {
+	r := loadFixtures(t)
+	if errs, known := r.Validate("ref:unknown", []byte(`{}`)); known || errs != nil {
+		t.Errorf("Validate(ref:unknown) = %v, %v, want no schema", errs, known)
+	}
+}
+
+func TestValidateMissingFormat(t *testing.T) {
+	r := writeSchemas(t, map[string]string{
+		"doc_json.json": `{"type": "object"}`,
+		"doc_xml.xsd":   `<xs:schema xmlns:xs="http://www.w3.org/2001/XMLSchema"><xs:element name="doc"/></xs:schema>`,
+	})
+	runValidate(t, r, []validateCase{
+		{name: "xml without xsd", dataType: "doc:json", body: `<doc/>`, paths: []string{"/"}},
+		{name: "json without json schema", dataType: "doc:xml", body: `{}`, paths: []string{"/"}},
+	})
+}
+
+func TestInherited(t *testing.T) {
+	r := &Registry{nested: map[string][]string{
+		"doc:order":  {"doc:base", "ref:party"},
+		"doc:base":   {"ref:base"},
+		"ref:party":  {"ref:base"},
+		"ref:base":   {"doc:order"},
+		"ref:unused": {"ref:sku"},
+	}}
+
+	got := r.inherited(FileName("doc:order"))
+	want := []string{"doc:base", "ref:party", "ref:base"}
+	if !slices.Equal(got, want) {
+		t.Errorf("inherited(doc:order) = %v, want %v", got, want)
+	}
+	if got := r.inherited(FileName("ref:sku")); len(got) != 0 {
+		t.Errorf("inherited(ref:sku) = %v, want none", got)
+	}
+}
+
+func TestValidateTransitiveInheritance(t *testing.T) {
+	r := writeSchemas(t, map[string]string{
+		"nested.yaml": "doc:order: [doc:base]\ndoc:base: [ref:base]\n",
+		"ref_base.xsd": `<xs:schema xmlns:xs="http://www.w3.org/2001/XMLSchema">
+  <xs:simpleType name="Code">
+    <xs:restriction base="xs:string"><xs:pattern value="[A-Z]{3}"/></xs:restriction>
+  </xs:simpleType>
+</xs:schema>`,
+		"doc_base.xsd": `<xs:schema xmlns:xs="http://www.w3.org/2001/XMLSchema">
+  <xs:complexType name="Document">
+    <xs:sequence><xs:element name="currency" type="Code"/></xs:sequence>
+    <xs:attribute name="number" type="xs:int" use="required"/>
+  </xs:complexType>
+</xs:schema>`,
+		"doc_order.xsd": `<xs:schema xmlns:xs="http://www.w3.org/2001/XMLSchema">
+  <xs:element name="order">
+    <xs:complexType>
+      <xs:complexContent>
+        <xs:extension base="Document">
+          <xs:sequence>
+            <xs:element name="customer">
+              <xs:complexType>
+                <xs:sequence>
+                  <xs:element name="name" type="xs:string"/>
+                  <xs:element name="address" minOccurs="0">
+                    <xs:complexType>
+                      <xs:sequence><xs:element name="city" type="xs:string"/></xs:sequence>
+                    </xs:complexType>
+                  </xs:element>
+                </xs:sequence>
+              </xs:complexType>
+            </xs:element>
+          </xs:sequence>
+        </xs:extension>
+      </xs:complexContent>
+    </xs:complexType>
+  </xs:element>
+</xs:schema>`,
+		"doc_base.json": `{"type": "object", "required": ["number"]}`,
+		"ref_base.json": `{"type": "object", "properties": {"currency": {"type": "string", "pattern": "^[A-Z]{3}$"}}}`,
+		"doc_order.json": `{"type": "object", "required": ["customer"],
+  "properties": {"customer": {"type": "object", "required": ["name"],
+    "properties": {"address": {"type": "object", "required": ["city"]}}}}}`,
+	})
+
+	runValidate(t, r, []validateCase{
+		{
+			name:     "xml",
+			dataType: "doc:order",
+			body:     `<order number="7"><currency>EUR</currency><customer><name>A</name><address><city>B</city></address></customer></order>`,
+		},
+		{
+			name:     "xml optional nested element",
+			dataType: "doc:order",
+			body:     `<order number="7"><currency>EUR</currency><customer><name>A</name></customer></order>`,
+		},
+		{
+			name:     "xml type of grandparent",
+			dataType: "doc:order",
+			body:     `<order number="7"><currency>euro</currency><customer><name>A</name></customer></order>`,
+			paths:    []string{"/order/currency"},
+		},
+		{
+			name:     "xml attribute of parent",
+			dataType: "doc:order",
+			body:     `<order number="seven"><currency>EUR</currency><customer><name>A</name></customer></order>`,
+			paths:    []string{"/order/@number"},
+		},
+		{
+			name:     "xml missing required attribute",
+			dataType: "doc:order",
+			body:     `<order><currency>EUR</currency><customer><name>A</name></customer></order>`,
+			paths:    []string{"/order/@number"},
+		},
+		{
+			name:     "xml deeply nested",
+			dataType: "doc:order",
+			body:     `<order number="7"><currency>EUR</currency><customer><name>A</name><address/></customer></order>`,
+			paths:    []string{"/order/customer/address/city"},
+		},
+		{
+			name:     "json",
+			dataType: "doc:order",
+			body:     `{"number": 7, "currency": "EUR", "customer": {"name": "A", "address": {"city": "B"}}}`,
+		},
+		{
+			name:     "json every level",
+			dataType: "doc:order",
+			body:     `{"currency": "euro", "customer": {"address": {}}}`,
+			paths:    []string{"/", "/currency", "/customer", "/customer/address"},
+		},
+	})
+}
+
+func TestValidateOccurs(t *testing.T) {
+	r := writeSchemas(t, map[string]string{
+		"doc_list.xsd": `<xs:schema xmlns:xs="http://www.w3.org/2001/XMLSchema">
+  <xs:element name="list">
+    <xs:complexType>
+      <xs:sequence>
+        <xs:element name="head" type="xs:string" minOccurs="0"/>
+        <xs:element name="line" type="xs:int" minOccurs="2" maxOccurs="3"/>
+        <xs:element name="note" type="xs:string" minOccurs="0" maxOccurs="unbounded"/>
+        <xs:choice minOccurs="1" maxOccurs="2">
+          <xs:element name="a" type="xs:string"/>
+          <xs:element name="b" type="xs:string"/>
+        </xs:choice>
+      </xs:sequence>
+    </xs:complexType>
+  </xs:element>
+</xs:schema>`,
+	})
+
+	lines := func(n int) string {
+		return strings.Repeat("<line>1</line>", n)
+	}
+	runValidate(t, r, []validateCase{
+		{name: "minimum", dataType: "doc:list", body: "<list>" + lines(2) + "<a/></list>"},
+		{name: "maximum", dataType: "doc:list", body: "<list><head/>" + lines(3) + "<note/><note/><note/><note/><a/><b/></list>"},
+		{name: "below minOccurs", dataType: "doc:list", body: "<list>" + lines(1) + "<a/></list>", paths: []string{"/list/line"}},
+		{name: "none of required", dataType: "doc:list", body: "<list><head/><a/></list>", paths: []string{"/list/line"}},
+		{name: "above maxOccurs", dataType: "doc:list", body: "<list>" + lines(4) + "<a/></list>", paths: []string{"/list", "/list/line", "/list/a"}},
+		{name: "choice missing", dataType: "doc:list", body: "<list>" + lines(2) + "</list>", paths: []string{"/list"}},
+		{name: "choice above maxOccurs", dataType: "doc:list", body: "<list>" + lines(2) + "<a/><b/><a/></list>", paths: []string{"/list/a"}},
+		{name: "invalid repeated value", dataType: "doc:list", body: "<list><line>1</line><line>x</line><a/></list>", paths: []string{"/list/line"}},
+	})
+}
+
+func TestLoadUnsupported(t *testing.T) {
+	tests := []struct {
+		name string
+		xsd  string
+	}{
+		{"identity constraint", `<xs:element name="doc"><xs:complexType/><xs:key name="k"><xs:selector xpath="a"/><xs:field xpath="@id"/></xs:key></xs:element>`},
+		{"whiteSpace facet", `<xs:simpleType name="Code"><xs:restriction base="xs:string"><xs:whiteSpace value="collapse"/></xs:restriction></xs:simpleType>`},
+		{"totalDigits facet", `<xs:simpleType name="Amount"><xs:restriction base="xs:decimal"><xs:totalDigits value="5"/></xs:restriction></xs:simpleType>`},
+		{"substitution group", `<xs:element name="head"/><xs:element name="doc" substitutionGroup="head"/>`},
+		{"fixed value", `<xs:element name="doc" type="xs:string" fixed="a"/>`},
+		{"nillable", `<xs:element name="doc" type="xs:string" nillable="true"/>`},
+		{"redefine", `<xs:redefine schemaLocation="other.xsd"/>`},
+		{"remote import", `<xs:import namespace="urn:x" schemaLocation="http://example.com/x.xsd"/>`},
+		{"undefined type", `<xs:element name="doc" type="Missing"/>`},
+		{"undefined built-in type", `<xs:element name="doc" type="xs:gYear"/>`},
+		{"undefined base", `<xs:complexType name="Doc"><xs:complexContent><xs:extension base="Missing"/></xs:complexContent></xs:complexType>`},
+		{"undefined element reference", `<xs:element name="doc"><xs:complexType><xs:sequence><xs:element ref="missing"/></xs:sequence></xs:complexType></xs:element>`},
+		{"undefined group reference", `<xs:complexType name="Doc"><xs:group ref="missing"/></xs:complexType>`},
+		{"undefined union member", `<xs:simpleType name="Code"><xs:union memberTypes="xs:int Missing"/></xs:simpleType>`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			xsd := `<xs:schema xmlns:xs="http://www.w3.org/2001/XMLSchema">` + tt.xsd + `</xs:schema>`
+			if err := os.WriteFile(filepath.Join(dir, "doc_x.xsd"), []byte(xsd), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := Load(dir); err == nil {
+				t.Error("Load accepted the schema")
+			}
+		})
+	}
+}
+
+func TestLoadSupported(t *testing.T) {
+	writeSchemas(t, map[string]string{
+		"doc_x.xsd": `<xs:schema xmlns:xs="http://www.w3.org/2001/XMLSchema">
+  <xs:annotation><xs:documentation><p>Any <b>markup</b></p></xs:documentation></xs:annotation>
+  <xs:include schemaLocation="doc_common.xsd"/>
+  <xs:element name="doc">
+    <xs:complexType>
+      <xs:sequence>
+        <xs:element ref="code"/>
+        <xs:group ref="Lines"/>
+        <xs:element name="when" type="Moment" nillable="false"/>
+      </xs:sequence>
+      <xs:attributeGroup ref="Common"/>
+    </xs:complexType>
+  </xs:element>
+  <xs:simpleType name="Moment"><xs:union memberTypes="xs:date xs:dateTime"/></xs:simpleType>
+</xs:schema>`,
+		"doc_common.xsd": `<xs:schema xmlns:xs="http://www.w3.org/2001/XMLSchema">
+  <xs:element name="code"><xs:simpleType><xs:list itemType="xs:token"/></xs:simpleType></xs:element>
+  <xs:group name="Lines"><xs:sequence><xs:element name="line" type="xs:int" maxOccurs="unbounded"/></xs:sequence></xs:group>
+  <xs:attributeGroup name="Common"><xs:attribute name="id" type="xs:ID"/></xs:attributeGroup>
+</xs:schema>`,
+	})
+}
@@ -0,0 +1,901 @@
+package schema
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"math/big"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const xsiNamespace = "http://www.w3.org/2001/XMLSchema-instance"
+
+type xsdNode struct {
+	XMLName  xml.Name
+	Attrs    []xml.Attr `xml:",any,attr"`
+	Children []*xsdNode `xml:",any"`
+}
+
+func (n *xsdNode) attr(name string) string {
+	for _, a := range n.Attrs {
+		if a.Name.Local == name {
+			return a.Value
+		}
+	}
+	return ""
+}
+
+func (n *xsdNode) kind() string {
+	return n.XMLName.Local
+}
+
+func (n *xsdNode) child(kind string) *xsdNode {
+	for _, c := range n.Children {
+		if c.kind() == kind {
+			return c
+		}
+	}
+	return nil
+}
+
+// occurs returns minOccurs and maxOccurs; a negative max means unbounded.
+func (n *xsdNode) occurs() (int, int) {
+	min, max := 1, 1
+	if v := n.attr("minOccurs"); v != "" {
+		min, _ = strconv.Atoi(v)
+	}
+	if v := n.attr("maxOccurs"); v == "unbounded" {
+		max = -1
+	} else if v != "" {
+		max, _ = strconv.Atoi(v)
+	}
+	return min, max
+}
+
+// supported lists the XSD elements the validator understands. A schema using
+// any other one fails to load instead of being validated partly.
+var supported = map[string]bool{
+	"schema": true, "annotation": true, "include": true, "import": true,
+	"element": true, "attribute": true, "complexType": true, "simpleType": true,
+	"sequence": true, "choice": true, "all": true, "any": true, "anyAttribute": true,
+	"group": true, "attributeGroup": true,
+	"complexContent": true, "simpleContent": true, "extension": true, "restriction": true,
+	"list": true, "union": true,
+	"enumeration": true, "pattern": true, "length": true, "minLength": true, "maxLength": true,
+	"minInclusive": true, "maxInclusive": true, "minExclusive": true, "maxExclusive": true,
+}
+
+// ignoredAttrs are attributes the validator would ignore although they
+// change what a valid document is.
+var ignoredAttrs = []string{"substitutionGroup", "abstract", "fixed", "nillable"}
+
+// check rejects the constructs outside of the supported subset.
+func (n *xsdNode) check() error {
+	if !supported[n.kind()] {
+		return fmt.Errorf("unsupported XSD construct %s", n.kind())
+	}
+	for _, name := range ignoredAttrs {
+		if value := n.attr(name); value != "" && value != "false" {
+			return fmt.Errorf("unsupported attribute %s of %s", name, n.kind())
+		}
+	}
+	if n.kind() == "annotation" {
+		return nil
+	}
+	for _, c := range n.Children {
+		if err := c.check(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func localName(qname string) string {
+	if i := strings.LastIndexByte(qname, ':'); i >= 0 {
+		return qname[i+1:]
+	}
+	return qname
+}
+
+type xsdSchema struct {
+	elements        map[string]*xsdNode
+	attributes      map[string]*xsdNode
+	complexTypes    map[string]*xsdNode
+	simpleTypes     map[string]*xsdNode
+	groups          map[string]*xsdNode
+	attributeGroups map[string]*xsdNode
+}
+
+func parseXsd(path string) (*xsdSchema, error) {
+	s := &xsdSchema{
+		elements:        make(map[string]*xsdNode),
+		attributes:      make(map[string]*xsdNode),
+		complexTypes:    make(map[string]*xsdNode),
+		simpleTypes:     make(map[string]*xsdNode),
+		groups:          make(map[string]*xsdNode),
+		attributeGroups: make(map[string]*xsdNode),
+	}
+	if err := s.load(path, map[string]bool{}); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *xsdSchema) load(path string, loaded map[string]bool) error {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	if loaded[abs] {
+		return nil
+	}
+	loaded[abs] = true
+
+	data, err := os.ReadFile(abs)
+	if err != nil {
+		return err
+	}
+	root := &xsdNode{}
+	if err := xml.Unmarshal(data, root); err != nil {
+		return err
+	}
+	if root.kind() != "schema" {
+		return fmt.Errorf("root element is %s, expected schema", root.kind())
+	}
+	if err := root.check(); err != nil {
+		return err
+	}
+
+	for _, n := range root.Children {
+		name := n.attr("name")
+		switch n.kind() {
+		case "element":
+			s.elements[name] = n
+		case "attribute":
+			s.attributes[name] = n
+		case "complexType":
+			s.complexTypes[name] = n
+		case "simpleType":
+			s.simpleTypes[name] = n
+		case "group":
+			s.groups[name] = n
+		case "attributeGroup":
+			s.attributeGroups[name] = n
+		case "include", "import":
+			location := n.attr("schemaLocation")
+			if strings.Contains(location, "://") {
+				return fmt.Errorf("remote schema location %s is not supported", location)
+			}
+			if location != "" {
+				if err := s.load(filepath.Join(filepath.Dir(abs), location), loaded); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// inherit makes the global declarations of parent visible, without
+// overriding declarations of the same name.
+func (s *xsdSchema) inherit(parent *xsdSchema) {
+	merge := func(dst, src map[string]*xsdNode) {
+		for name, n := range src {
+			if _, ok := dst[name]; !ok {
+				dst[name] = n
+			}
+		}
+	}
+	merge(s.elements, parent.elements)
+	merge(s.attributes, parent.attributes)
+	merge(s.complexTypes, parent.complexTypes)
+	merge(s.simpleTypes, parent.simpleTypes)
+	merge(s.groups, parent.groups)
+	merge(s.attributeGroups, parent.attributeGroups)
+}
+
+// resolve checks that every referenced type and declaration is defined in
+// the schema, the ones it inherits, or among the built-in types.
+func (s *xsdSchema) resolve() error {
+	var walk func(n *xsdNode) error
+	walk = func(n *xsdNode) error {
+		if n.kind() == "annotation" {
+			return nil
+		}
+		for _, attr := range []string{"type", "base", "itemType"} {
+			if name := n.attr(attr); name != "" && !s.isType(localName(name)) {
+				return fmt.Errorf("%s %s of %s is not defined", attr, name, n.kind())
+			}
+		}
+		for _, member := range strings.Fields(n.attr("memberTypes")) {
+			if !s.isType(localName(member)) {
+				return fmt.Errorf("member type %s of union is not defined", member)
+			}
+		}
+		if ref := n.attr("ref"); ref != "" {
+			declarations := map[string]map[string]*xsdNode{
+				"element":        s.elements,
+				"attribute":      s.attributes,
+				"group":          s.groups,
+				"attributeGroup": s.attributeGroups,
+			}[n.kind()]
+			if _, ok := declarations[localName(ref)]; !ok {
+				return fmt.Errorf("%s %s is not defined", n.kind(), ref)
+			}
+		}
+		for _, c := range n.Children {
+			if err := walk(c); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	for _, declarations := range []map[string]*xsdNode{s.elements, s.attributes, s.complexTypes, s.simpleTypes, s.groups, s.attributeGroups} {
+		for _, n := range declarations {
+			if err := walk(n); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *xsdSchema) isType(name string) bool {
+	_, isComplex := s.complexTypes[name]
+	_, isSimple := s.simpleTypes[name]
+	return isComplex || isSimple || builtinType(name)
+}
+
+type xmlElement struct {
+	name     string
+	attrs    []xml.Attr
+	children []*xmlElement
+	text     strings.Builder
+}
+
+func parseInstance(body []byte) (*xmlElement, error) {
+	decoder := xml.NewDecoder(bytes.NewReader(body))
+	var root *xmlElement
+	var stack []*xmlElement
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			el := &xmlElement{name: t.Name.Local, attrs: t.Attr}
+			if len(stack) > 0 {
+				parent := stack[len(stack)-1]
+				parent.children = append(parent.children, el)
+			} else if root == nil {
+				root = el
+			} else {
+				return nil, fmt.Errorf("multiple root elements")
+			}
+			stack = append(stack, el)
+		case xml.EndElement:
+			stack = stack[:len(stack)-1]
+		case xml.CharData:
+			if len(stack) > 0 {
+				stack[len(stack)-1].text.Write(t)
+			}
+		}
+	}
+	if root == nil {
+		return nil, fmt.Errorf("no root element")
+	}
+	return root, nil
+}
+
+type xsdValidator struct {
+	schema *xsdSchema
+	errs   []Error
+}
+
+func (s *xsdSchema) validate(body []byte) []Error {
+	root, err := parseInstance(body)
+	if err != nil {
+		return []Error{{Path: "/", Message: err.Error()}}
+	}
+
+	decl, ok := s.elements[root.name]
+	if !ok {
+		return []Error{{Path: "/" + root.name, Message: "element is not declared"}}
+	}
+
+	v := &xsdValidator{schema: s}
+	v.element(root, decl, "/"+root.name)
+	return v.errs
+}
+
+func (v *xsdValidator) fail(path string, format string, args ...interface{}) {
+	v.errs = append(v.errs, Error{Path: path, Message: fmt.Sprintf(format, args...)})
+}
+
+func (v *xsdValidator) element(el *xmlElement, decl *xsdNode, path string) {
+	if ref := decl.attr("ref"); ref != "" {
+		global, ok := v.schema.elements[localName(ref)]
+		if !ok {
+			v.fail(path, "unknown element reference %s", ref)
+			return
+		}
+		decl = global
+	}
+
+	for _, a := range el.attrs {
+		if a.Name.Space == xsiNamespace && a.Name.Local == "nil" && a.Value == "true" {
+			if decl.attr("nillable") != "true" {
+				v.fail(path, "element is not nillable")
+			}
+			return
+		}
+	}
+
+	if ct := decl.child("complexType"); ct != nil {
+		v.complex(el, ct, path)
+		return
+	}
+	if st := decl.child("simpleType"); st != nil {
+		v.simpleElement(el, path, func(value string) []string { return v.simpleNode(value, st) })
+		return
+	}
+
+	typeName := localName(decl.attr("type"))
+	if typeName == "" || typeName == "anyType" {
+		return
+	}
+	if ct, ok := v.schema.complexTypes[typeName]; ok {
+		v.complex(el, ct, path)
+		return
+	}
+	v.simpleElement(el, path, func(value string) []string { return v.simpleType(value, typeName) })
+}
+
+func (v *xsdValidator) simpleElement(el *xmlElement, path string, check func(string) []string) {
+	if len(el.children) > 0 {
+		v.fail(path, "element must not have child elements")
+	}
+	for _, msg := range check(el.text.String()) {
+		v.fail(path, "%s", msg)
+	}
+}
+
+type contentModel struct {
+	particles  []*xsdNode
+	attributes []*xsdNode
+	anyAttr    bool
+	mixed      bool
+	simple     func(value string) []string
+}
+
+func (v *xsdValidator) model(ct *xsdNode, m *contentModel, depth int) {
+	if depth > 32 {
+		return
+	}
+	if ct.attr("mixed") == "true" {
+		m.mixed = true
+	}
+
+	for _, c := range ct.Children {
+		switch c.kind() {
+		case "sequence", "choice", "all", "group":
+			m.particles = append(m.particles, c)
+		case "attribute":
+			m.attributes = append(m.attributes, c)
+		case "attributeGroup":
+			v.attributeGroup(c, m, depth)
+		case "anyAttribute":
+			m.anyAttr = true
+		case "complexContent":
+			if c.attr("mixed") == "true" {
+				m.mixed = true
+			}
+			if ext := c.child("extension"); ext != nil {
+				if base, ok := v.schema.complexTypes[localName(ext.attr("base"))]; ok {
+					v.model(base, m, depth+1)
+				}
+				v.model(ext, m, depth+1)
+			} else if res := c.child("restriction"); res != nil {
+				v.model(res, m, depth+1)
+			}
+		case "simpleContent":
+			if ext := c.child("extension"); ext != nil {
+				v.simpleContent(ext, m, depth)
+				v.model(ext, m, depth+1)
+			} else if res := c.child("restriction"); res != nil {
+				v.simpleContent(res, m, depth)
+				facets := res
+				base := m.simple
+				if base == nil {
+					base = func(string) []string { return nil }
+				}
+				m.simple = func(value string) []string {
+					if errs := base(value); len(errs) > 0 {
+						return errs
+					}
+					return v.facets(value, facets)
+				}
+				v.model(res, m, depth+1)
+			}
+		}
+	}
+}
+
+func (v *xsdValidator) simpleContent(derivation *xsdNode, m *contentModel, depth int) {
+	baseName := localName(derivation.attr("base"))
+	if base, ok := v.schema.complexTypes[baseName]; ok {
+		v.model(base, m, depth+1)
+		return
+	}
+	m.simple = func(value string) []string { return v.simpleType(value, baseName) }
+}
+
+func (v *xsdValidator) attributeGroup(ref *xsdNode, m *contentModel, depth int) {
+	group := ref
+	if name := ref.attr("ref"); name != "" {
+		var ok bool
+		if group, ok = v.schema.attributeGroups[localName(name)]; !ok {
+			return
+		}
+	}
+	v.model(group, m, depth+1)
+}
+
+func (v *xsdValidator) complex(el *xmlElement, ct *xsdNode, path string) {
+	m := &contentModel{}
+	v.model(ct, m, 0)
+
+	declared := map[string]bool{}
+	for _, decl := range m.attributes {
+		if ref := decl.attr("ref"); ref != "" {
+			if global, ok := v.schema.attributes[localName(ref)]; ok {
+				use := decl.attr("use")
+				decl = global
+				if use != "" {
+					decl = &xsdNode{XMLName: global.XMLName, Attrs: append([]xml.Attr{{Name: xml.Name{Local: "use"}, Value: use}}, global.Attrs...), Children: global.Children}
+				}
+			}
+		}
+		name := decl.attr("name")
+		declared[name] = true
+
+		value, present := "", false
+		for _, a := range el.attrs {
+			if a.Name.Local == name && a.Name.Space != xsiNamespace {
+				value, present = a.Value, true
+				break
+			}
+		}
+		if !present {
+			if decl.attr("use") == "required" {
+				v.fail(path+"/@"+name, "required attribute is missing")
+			}
+			continue
+		}
+		var errs []string
+		if st := decl.child("simpleType"); st != nil {
+			errs = v.simpleNode(value, st)
+		} else if typeName := localName(decl.attr("type")); typeName != "" {
+			errs = v.simpleType(value, typeName)
+		}
+		for _, msg := range errs {
+			v.fail(path+"/@"+name, "%s", msg)
+		}
+	}
+	if !m.anyAttr {
+		for _, a := range el.attrs {
+			if a.Name.Space == "xmlns" || a.Name.Local == "xmlns" || a.Name.Space == xsiNamespace {
+				continue
+			}
+			if !declared[a.Name.Local] {
+				v.fail(path+"/@"+a.Name.Local, "attribute is not declared")
+			}
+		}
+	}
+
+	if m.simple != nil {
+		v.simpleElement(el, path, m.simple)
+		return
+	}
+
+	if !m.mixed && strings.TrimSpace(el.text.String()) != "" {
+		v.fail(path, "text content is not allowed")
+	}
+
+	pos := 0
+	for _, p := range m.particles {
+		pos = v.match(p, el.children, pos, path)
+	}
+	for ; pos < len(el.children); pos++ {
+		v.fail(path+"/"+el.children[pos].name, "element is not expected here")
+	}
+}
+
+// match consumes children starting at pos according to the particle and
+// returns the position after the last consumed child. Matching is greedy.
+func (v *xsdValidator) match(p *xsdNode, children []*xmlElement, pos int, path string) int {
+	min, max := p.occurs()
+
+	switch p.kind() {
+	case "element":
+		name := p.attr("name")
+		if name == "" {
+			name = localName(p.attr("ref"))
+		}
+		count := 0
+		for pos < len(children) && (max < 0 || count < max) && children[pos].name == name {
+			v.element(children[pos], p, path+"/"+name)
+			pos++
+			count++
+		}
+		if count < min {
+			v.fail(path+"/"+name, "element is missing")
+		}
+	case "any":
+		count := 0
+		for pos < len(children) && (max < 0 || count < max) {
+			pos++
+			count++
+		}
+		if count < min {
+			v.fail(path, "expected %d more elements", min-count)
+		}
+	case "sequence", "choice", "group":
+		for count := 0; max < 0 || count < max; count++ {
+			if count >= min && !v.startsWith(p, children, pos) {
+				break
+			}
+			start := pos
+			pos = v.matchOnce(p, children, pos, path)
+			if pos == start {
+				break
+			}
+		}
+	case "all":
+		remaining := map[string]*xsdNode{}
+		for _, c := range p.Children {
+			if c.kind() == "element" {
+				name := c.attr("name")
+				if name == "" {
+					name = localName(c.attr("ref"))
+				}
+				remaining[name] = c
+			}
+		}
+		consumed := false
+		for pos < len(children) {
+			decl, ok := remaining[children[pos].name]
+			if !ok {
+				break
+			}
+			v.element(children[pos], decl, path+"/"+children[pos].name)
+			delete(remaining, children[pos].name)
+			pos++
+			consumed = true
+		}
+		if consumed || min > 0 {
+			for name, decl := range remaining {
+				if elMin, _ := decl.occurs(); elMin > 0 {
+					v.fail(path+"/"+name, "element is missing")
+				}
+			}
+		}
+	}
+	return pos
+}
+
+func (v *xsdValidator) matchOnce(p *xsdNode, children []*xmlElement, pos int, path string) int {
+	switch p.kind() {
+	case "sequence":
+		for _, c := range p.Children {
+			pos = v.match(c, children, pos, path)
+		}
+	case "choice":
+		var names []string
+		optional := false
+		for _, c := range p.Children {
+			if c.kind() == "annotation" {
+				continue
+			}
+			if v.startsWith(c, children, pos) {
+				return v.match(c, children, pos, path)
+			}
+			if min, _ := c.occurs(); min == 0 {
+				optional = true
+			}
+			names = append(names, c.attr("name"))
+		}
+		if !optional {
+			v.fail(path, "expected one of %s", strings.Join(names, ", "))
+		}
+	case "group":
+		if group, ok := v.schema.groups[localName(p.attr("ref"))]; ok {
+			for _, c := range group.Children {
+				pos = v.match(c, children, pos, path)
+			}
+		}
+	}
+	return pos
+}
+
+// startsWith reports whether the child at pos can begin the particle.
+func (v *xsdValidator) startsWith(p *xsdNode, children []*xmlElement, pos int) bool {
+	if pos >= len(children) {
+		return false
+	}
+
+	switch p.kind() {
+	case "element":
+		name := p.attr("name")
+		if name == "" {
+			name = localName(p.attr("ref"))
+		}
+		return children[pos].name == name
+	case "any":
+		return true
+	case "sequence":
+		for _, c := range p.Children {
+			if v.startsWith(c, children, pos) {
+				return true
+			}
+			if min, _ := c.occurs(); min > 0 && c.kind() != "annotation" {
+				return false
+			}
+		}
+	case "choice", "all":
+		for _, c := range p.Children {
+			if v.startsWith(c, children, pos) {
+				return true
+			}
+		}
+	case "group":
+		if group, ok := v.schema.groups[localName(p.attr("ref"))]; ok {
+			for _, c := range group.Children {
+				if v.startsWith(c, children, pos) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+func (v *xsdValidator) simpleType(value string, typeName string) []string {
+	if st, ok := v.schema.simpleTypes[typeName]; ok {
+		return v.simpleNode(value, st)
+	}
+	if err := builtinValid(typeName, value); err != nil {
+		return []string{err.Error()}
+	}
+	return nil
+}
+
+func (v *xsdValidator) simpleNode(value string, st *xsdNode) []string {
+	if res := st.child("restriction"); res != nil {
+		var errs []string
+		if inline := res.child("simpleType"); inline != nil {
+			errs = v.simpleNode(value, inline)
+		} else {
+			errs = v.simpleType(value, localName(res.attr("base")))
+		}
+		if len(errs) > 0 {
+			return errs
+		}
+		return v.facets(value, res)
+	}
+
+	if list := st.child("list"); list != nil {
+		for _, item := range strings.Fields(value) {
+			var errs []string
+			if inline := list.child("simpleType"); inline != nil {
+				errs = v.simpleNode(item, inline)
+			} else {
+				errs = v.simpleType(item, localName(list.attr("itemType")))
+			}
+			if len(errs) > 0 {
+				return errs
+			}
+		}
+		return nil
+	}
+
+	if union := st.child("union"); union != nil {
+		for _, member := range strings.Fields(union.attr("memberTypes")) {
+			if len(v.simpleType(value, localName(member))) == 0 {
+				return nil
+			}
+		}
+		for _, inline := range union.Children {
+			if inline.kind() == "simpleType" && len(v.simpleNode(value, inline)) == 0 {
+				return nil
+			}
+		}
+		return []string{fmt.Sprintf("value %q does not match any union member", value)}
+	}
+
+	return nil
+}
+
+func (v *xsdValidator) facets(value string, res *xsdNode) []string {
+	var errs []string
+	var enumeration []string
+	var patterns []string
+	trimmed := strings.TrimSpace(value)
+	length := utf8.RuneCountInString(value)
+
+	for _, f := range res.Children {
+		limit := f.attr("value")
+		switch f.kind() {
+		case "enumeration":
+			enumeration = append(enumeration, limit)
+		case "pattern":
+			patterns = append(patterns, limit)
+		case "length":
+			if n, err := strconv.Atoi(limit); err == nil && length != n {
+				errs = append(errs, fmt.Sprintf("length must be %d", n))
+			}
+		case "minLength":
+			if n, err := strconv.Atoi(limit); err == nil && length < n {
+				errs = append(errs, fmt.Sprintf("length must be at least %d", n))
+			}
+		case "maxLength":
+			if n, err := strconv.Atoi(limit); err == nil && length > n {
+				errs = append(errs, fmt.Sprintf("length must be at most %d", n))
+			}
+		case "minInclusive", "maxInclusive", "minExclusive", "maxExclusive":
+			x, errX := strconv.ParseFloat(trimmed, 64)
+			y, errY := strconv.ParseFloat(limit, 64)
+			if errX != nil || errY != nil {
+				continue
+			}
+			if (f.kind() == "minInclusive" && x < y) || (f.kind() == "maxInclusive" && x > y) ||
+				(f.kind() == "minExclusive" && x <= y) || (f.kind() == "maxExclusive" && x >= y) {
+				errs = append(errs, fmt.Sprintf("value %s violates %s %s", trimmed, f.kind(), limit))
+			}
+		}
+	}
+
+	if len(enumeration) > 0 {
+		found := false
+		for _, e := range enumeration {
+			if e == value || e == trimmed {
+				found = true
+				break
+			}
+		}
+		if !found {
+			errs = append(errs, fmt.Sprintf("value %q is not one of %s", value, strings.Join(enumeration, ", ")))
+		}
+	}
+
+	if len(patterns) > 0 {
+		matched := false
+		for _, p := range patterns {
+			re, err := regexp.Compile("^(?:" + p + ")$")
+			if err == nil && re.MatchString(value) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			errs = append(errs, fmt.Sprintf("value %q does not match pattern %s", value, strings.Join(patterns, " | ")))
+		}
+	}
+
+	return errs
+}
+
+var (
+	decimalPattern  = regexp.MustCompile(`^[+-]?(\d+(\.\d*)?|\.\d+)$`)
+	durationPattern = regexp.MustCompile(`^-?P(\d+Y)?(\d+M)?(\d+D)?(T(\d+H)?(\d+M)?(\d+(\.\d+)?S)?)?$`)
+	integerBounds   = map[string][2]string{
+		"integer":            {"", ""},
+		"long":               {"-9223372036854775808", "9223372036854775807"},
+		"int":                {"-2147483648", "2147483647"},
+		"short":              {"-32768", "32767"},
+		"byte":               {"-128", "127"},
+		"nonNegativeInteger": {"0", ""},
+		"positiveInteger":    {"1", ""},
+		"nonPositiveInteger": {"", "0"},
+		"negativeInteger":    {"", "-1"},
+		"unsignedLong":       {"0", "18446744073709551615"},
+		"unsignedInt":        {"0", "4294967295"},
+		"unsignedShort":      {"0", "65535"},
+		"unsignedByte":       {"0", "255"},
+	}
+	dateLayouts     = []string{"2006-01-02", "2006-01-02Z07:00"}
+	dateTimeLayouts = []string{"2006-01-02T15:04:05.999999999", "2006-01-02T15:04:05.999999999Z07:00"}
+	timeLayouts     = []string{"15:04:05.999999999", "15:04:05.999999999Z07:00"}
+)
+
+// stringTypes are the built-in types whose values are checked as plain
+// strings.
+var stringTypes = map[string]bool{
+	"anyType": true, "anySimpleType": true, "string": true, "normalizedString": true, "token": true,
+	"language": true, "Name": true, "NCName": true, "NMTOKEN": true, "NMTOKENS": true,
+	"ID": true, "IDREF": true, "IDREFS": true, "QName": true, "anyURI": true,
+}
+
+func builtinType(typeName string) bool {
+	if _, ok := integerBounds[typeName]; ok || stringTypes[typeName] {
+		return true
+	}
+	switch typeName {
+	case "boolean", "decimal", "float", "double", "date", "dateTime", "time", "duration", "base64Binary", "hexBinary":
+		return true
+	}
+	return false
+}
+
+func builtinValid(typeName string, value string) error {
+	trimmed := strings.TrimSpace(value)
+
+	if bounds, ok := integerBounds[typeName]; ok {
+		n, ok := new(big.Int).SetString(strings.TrimPrefix(trimmed, "+"), 10)
+		if !ok {
+			return fmt.Errorf("value %q is not a valid %s", value, typeName)
+		}
+		if min, ok := new(big.Int).SetString(bounds[0], 10); ok && n.Cmp(min) < 0 {
+			return fmt.Errorf("value %q is out of range for %s", value, typeName)
+		}
+		if max, ok := new(big.Int).SetString(bounds[1], 10); ok && n.Cmp(max) > 0 {
+			return fmt.Errorf("value %q is out of range for %s", value, typeName)
+		}
+		return nil
+	}
+
+	var valid bool
+	switch typeName {
+	case "boolean":
+		valid = trimmed == "true" || trimmed == "false" || trimmed == "1" || trimmed == "0"
+	case "decimal":
+		valid = decimalPattern.MatchString(trimmed)
+	case "float", "double":
+		_, err := strconv.ParseFloat(trimmed, 64)
+		valid = err == nil || trimmed == "INF" || trimmed == "-INF" || trimmed == "NaN"
+	case "date":
+		valid = parsesAny(trimmed, dateLayouts)
+	case "dateTime":
+		valid = parsesAny(trimmed, dateTimeLayouts)
+	case "time":
+		valid = parsesAny(trimmed, timeLayouts)
+	case "duration":
+		valid = trimmed != "P" && trimmed != "-P" && !strings.HasSuffix(trimmed, "T") && durationPattern.MatchString(trimmed)
+	case "base64Binary":
+		_, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(value), ""))
+		valid = err == nil
+	case "hexBinary":
+		_, err := hex.DecodeString(trimmed)
+		valid = err == nil
+	default:
+		valid = true
+	}
+
+	if !valid {
+		return fmt.Errorf("value %q is not a valid %s", value, typeName)
+	}
+	return nil
+}
+
+func parsesAny(value string, layouts []string) bool {
+	for _, layout := range layouts {
+		if _, err := time.Parse(layout, value); err == nil {
+			return true
+		}
+	}
+	return false
+}
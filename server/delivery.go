@@ -0,0 +1,438 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"stress/breaker"
+	. "stress/common"
+	"stress/ibsession"
+
+	"gopkg.in/yaml.v3"
+)
+
+type DestinationConfig struct {
+	SystemID   string        `yaml:"system_id"`
+	Resource   string        `yaml:"resource"`
+	MsgUrl     string        `yaml:"msg_url"`
+	InfoUrl    string        `yaml:"info_url"`
+	User       string        `yaml:"user"`
+	Password   string        `yaml:"password"`
+	UseSession bool          `yaml:"use_session"`
+	Workers    int           `yaml:"workers"`
+	QueueSize  int           `yaml:"queue_size"`
+	Retries    int           `yaml:"retries"`
+	RetryDelay time.Duration `yaml:"retry_delay"`
+	Timeouts   Timeouts      `yaml:"timeouts"`
+
+	Sessions ibsession.Config `yaml:"sessions"`
+
+	CircuitBreaker *breaker.Config `yaml:"circuit_breaker"`
+}
+
+type Destination struct {
+	Config   DestinationConfig
+	Stats    *DestinationStats
+	Breaker  *breaker.Breaker
+	Sessions *ibsession.Pool
+	queue    chan *requestTask
+}
+
+type DestinationStats struct {
+	Queued              int
+	Delivered           int
+	Failed              int
+	Retries             int
+	ConsecutiveFailures int
+	TotalDuration       time.Duration
+	MaxDuration         time.Duration
+	Errors              map[string]int
+	mutex               sync.Mutex
+}
+
+func (s *DestinationStats) RecordQueued() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.Queued++
+}
+
+func (s *DestinationStats) RecordRetry() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.Retries++
+}
+
+func (s *DestinationStats) RecordDelivery(success bool, duration time.Duration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if success {
+		s.Delivered++
+		s.ConsecutiveFailures = 0
+	} else {
+		s.Failed++
+		s.ConsecutiveFailures++
+	}
+
+	s.TotalDuration += duration
+	if duration > s.MaxDuration {
+		s.MaxDuration = duration
+	}
+}
+
+func (s *DestinationStats) RecordError(class string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.Errors[class]++
+}
+
+func (s *DestinationStats) GetSummary(queueLength int) Fields {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	avgDuration := time.Duration(0)
+	if done := s.Delivered + s.Failed; done > 0 {
+		avgDuration = time.Duration(int64(s.TotalDuration) / int64(done))
+	}
+
+	return Fields{
+		"Queued":              s.Queued,
+		"Delivered":           s.Delivered,
+		"Failed":              s.Failed,
+		"Retries":             s.Retries,
+		"ConsecutiveFailures": s.ConsecutiveFailures,
+		"QueueLength":         queueLength,
+		"AverageDuration":     avgDuration,
+		"MaxDuration":         s.MaxDuration,
+		"Errors":              maps.Clone(s.Errors),
+	}
+}
+
+func (c *DestinationConfig) setDefaults() {
+	base := strings.TrimSuffix(c.Resource, "/")
+	if c.MsgUrl == "" {
+		c.MsgUrl = base + "/msg"
+	}
+	if c.InfoUrl == "" {
+		c.InfoUrl = base + "/info/"
+	}
+	if c.Workers <= 0 {
+		c.Workers = 1
+	}
+	if c.QueueSize <= 0 {
+		c.QueueSize = c.Workers * 2
+	}
+	if c.RetryDelay <= 0 {
+		c.RetryDelay = 100 * time.Millisecond
+	}
+	if c.Timeouts.Total <= 0 {
+		c.Timeouts.Total = 1 * time.Second
+	}
+	if c.Sessions.Size <= 0 {
+		c.Sessions.Size = c.Workers
+	}
+}
+
+// AddDestination registers the destination of a system and starts its
+// workers. A destination already registered for the system is replaced: it
+// keeps its statistics, and its queue is closed so that the old workers
+// deliver what is queued and exit. Destinations are added before the server
+// accepts requests.
+func (s *Server) AddDestination(config DestinationConfig) (*Destination, error) {
+	config.setDefaults()
+
+	dest := &Destination{
+		Config: config,
+		Stats:  &DestinationStats{Errors: make(map[string]int)},
+		queue:  make(chan *requestTask, config.QueueSize),
+	}
+	if config.CircuitBreaker != nil {
+		if err := s.setBreaker(dest, *config.CircuitBreaker); err != nil {
+			return nil, err
+		}
+	}
+
+	s.destMutex.Lock()
+	previous, replaced := s.destinations[config.SystemID]
+	if replaced {
+		dest.Stats = previous.Stats
+	}
+	s.destinations[config.SystemID] = dest
+	s.destMutex.Unlock()
+
+	if replaced {
+		close(previous.queue)
+		previous.Sessions.Close()
+		s.Logger.Info().
+			Str("destination", dest.Name()).
+			Msg("Destination replaced")
+	}
+
+	transport := &http.Transport{}
+	config.Timeouts.Apply(transport)
+	dest.Sessions = ibsession.NewPool(config.InfoUrl, config.User, config.Password, config.Sessions,
+		&http.Client{Timeout: config.Timeouts.Total, Transport: transport})
+	if config.UseSession && config.Sessions.Prewarm > 0 {
+		go s.prewarmSessions(dest)
+	}
+	if interval := sessionExpiryInterval(config.Sessions); interval > 0 {
+		go dest.Sessions.Expire(interval, s.done)
+	}
+
+	for i := 0; i < config.Workers; i++ {
+		go s.workerLoop(dest, NewSession(config.User, config.Password, config.UseSession, dest.Sessions, config.Timeouts))
+	}
+
+	return dest, nil
+}
+
+func (s *Server) setBreaker(dest *Destination, config breaker.Config) error {
+	b, err := breaker.New(dest.Name(), config, s.logBreakerChange)
+	if err != nil {
+		return err
+	}
+	dest.Breaker = b
+	return nil
+}
+
+// SetDefaultBreaker puts a circuit breaker with the config in front of every
+// destination that has none of its own.
+func (s *Server) SetDefaultBreaker(config breaker.Config) error {
+	s.destMutex.Lock()
+	defer s.destMutex.Unlock()
+
+	for _, dest := range s.destinations {
+		if dest.Breaker != nil {
+			continue
+		}
+		if err := s.setBreaker(dest, config); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CheckDLQs verifies that every destination routing to a dead letter
+// destination while its circuit is open has one to route to.
+func (s *Server) CheckDLQs() error {
+	s.destMutex.RLock()
+	defer s.destMutex.RUnlock()
+
+	for _, dest := range s.destinations {
+		if dest.Breaker == nil || dest.Breaker.Config.OnOpen != breaker.OnOpenDLQ {
+			continue
+		}
+		dlq, ok := s.destinations[dest.Breaker.Config.DLQ]
+		if !ok {
+			return fmt.Errorf("dead letter destination %q of %s is not configured", dest.Breaker.Config.DLQ, dest.Name())
+		}
+		if dlq == dest {
+			return fmt.Errorf("destination %s is its own dead letter destination", dest.Name())
+		}
+	}
+	return nil
+}
+
+func (s *Server) logBreakerChange(b *breaker.Breaker, from, to string) {
+	event := s.Logger.Info()
+	if to == breaker.StateOpen {
+		event = s.Logger.Warn()
+	}
+	event.
+		Str("destination", b.Name).
+		Str("from", from).
+		Str("to", to).
+		Msg("Circuit breaker state changed")
+}
+
+// route picks the destination of a task, honoring the circuit breaker: while
+// it is open the task is either failed fast or sent to the dead letter
+// destination.
+func (s *Server) route(dest *Destination, headers http.Header) (*Destination, http.Header, error) {
+	if dest.Breaker == nil {
+		return dest, headers, nil
+	}
+	err := dest.Breaker.Allow()
+	if err == nil || dest.Breaker.Config.OnOpen != breaker.OnOpenDLQ {
+		return dest, headers, err
+	}
+
+	s.destMutex.RLock()
+	dlq, ok := s.destinations[dest.Breaker.Config.DLQ]
+	s.destMutex.RUnlock()
+	if !ok || dlq == dest {
+		return dest, headers, err
+	}
+
+	headers = headers.Clone()
+	headers.Set("x-esb-dlq-reason", "circuit_open")
+	headers.Set("x-esb-dlq-destination", dest.Name())
+	return dlq, headers, nil
+}
+
+func (s *Server) destination(systemID string) *Destination {
+	s.destMutex.RLock()
+	defer s.destMutex.RUnlock()
+
+	if dest, ok := s.destinations[systemID]; ok {
+		return dest
+	}
+	return s.destinations[""]
+}
+
+func (d *Destination) Name() string {
+	if d.Config.SystemID == "" {
+		return "default"
+	}
+	return d.Config.SystemID
+}
+
+func (s *Server) prewarmSessions(dest *Destination) {
+	startTime := time.Now()
+	err := dest.Sessions.Prewarm(context.Background())
+	if err != nil {
+		s.Logger.Error().Str("destination", dest.Name()).Err(err).Msg("Error prewarming 1C sessions")
+		return
+	}
+	s.Logger.Info().
+		Str("destination", dest.Name()).
+		Int("sessions", dest.Config.Sessions.Prewarm).
+		Dur("duration", time.Since(startTime)).
+		Msg("1C sessions prewarmed")
+}
+
+// sessionExpiryInterval is how often idle sessions are checked for expiry,
+// half of the shorter limit.
+func sessionExpiryInterval(config ibsession.Config) time.Duration {
+	interval := config.MaxAge
+	if config.IdleTimeout > 0 && (interval <= 0 || config.IdleTimeout < interval) {
+		interval = config.IdleTimeout
+	}
+	return interval / 2
+}
+
+func (s *Server) closeSessions() {
+	s.destMutex.RLock()
+	defer s.destMutex.RUnlock()
+
+	for _, dest := range s.destinations {
+		dest.Sessions.Close()
+	}
+}
+
+func (d *Destination) send(sess *HttpSession, task *requestTask) responseResult {
+	result, session := d.trySend(sess, task)
+	if result.err == nil && result.statusCode != http.StatusOK && d.Sessions.Invalid(result.body) {
+		if session != nil {
+			d.Sessions.Discard(session)
+		}
+		sess.useSession = true
+		result, session = d.trySend(sess, task)
+	}
+
+	if session != nil {
+		if result.err == nil && result.statusCode != http.StatusOK && d.Sessions.Invalid(result.body) {
+			d.Sessions.Discard(session)
+		} else {
+			d.Sessions.Put(session)
+		}
+	}
+	return result
+}
+
+func (d *Destination) trySend(sess *HttpSession, task *requestTask) (responseResult, *ibsession.Session) {
+	resp, session, err := sess.TrySend(http.MethodPost, d.Config.MsgUrl, string(task.body), task.headers)
+	if err != nil {
+		return responseResult{err: err}, session
+	}
+
+	responseText, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	return responseResult{statusCode: resp.StatusCode, body: responseText}, session
+}
+
+func (r responseResult) retryable() bool {
+	return r.err != nil || r.statusCode >= http.StatusInternalServerError
+}
+
+func (s *Server) logDestinationStats() {
+	s.destMutex.RLock()
+	defer s.destMutex.RUnlock()
+
+	for _, dest := range s.destinations {
+		s.Logger.Info().
+			Str("destination", dest.Name()).
+			Interface("Statistics", dest.Stats.GetSummary(len(dest.queue))).
+			Msg("Destination statistics")
+		if dest.Breaker != nil {
+			s.Logger.Info().
+				Str("destination", dest.Name()).
+				Interface("Statistics", dest.Breaker.Stats()).
+				Msg("Circuit breaker statistics")
+		}
+		if dest.Config.UseSession {
+			s.Logger.Info().
+				Str("destination", dest.Name()).
+				Interface("Statistics", dest.Sessions.Stats()).
+				Msg("Session pool statistics")
+		}
+	}
+}
+
+func loadDestinations(path string) ([]DestinationConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read destinations file: %w", err)
+	}
+
+	var file struct {
+		Destinations []DestinationConfig `yaml:"destinations"`
+	}
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("failed to parse destinations file: %w", err)
+	}
+	return file.Destinations, nil
+}
+
+func loadDestinationsDB(ctx context.Context, db *sql.DB, defaults DestinationConfig) ([]DestinationConfig, error) {
+	rows, err := db.QueryContext(ctx, `select system_id, resource from systems where active and coalesce(resource, '') <> ''`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load systems: %w", err)
+	}
+	defer rows.Close()
+
+	var configs []DestinationConfig
+	for rows.Next() {
+		config := defaults
+		if err := rows.Scan(&config.SystemID, &config.Resource); err != nil {
+			return nil, fmt.Errorf("failed to read system: %w", err)
+		}
+		configs = append(configs, config)
+	}
+	return configs, rows.Err()
+}
+
+func mergeDestinations(base []DestinationConfig, overrides []DestinationConfig) []DestinationConfig {
+	merged := slices.Clone(base)
+	for _, override := range overrides {
+		i := slices.IndexFunc(merged, func(c DestinationConfig) bool { return c.SystemID == override.SystemID })
+		if i < 0 {
+			merged = append(merged, override)
+		} else {
+			merged[i] = override
+		}
+	}
+	return merged
+}
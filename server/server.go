@@ -1,15 +1,31 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"math"
 	"net/http"
 	"os"
 	"os/signal"
-	"slices"
 	"strconv"
+	"stress/breaker"
 	. "stress/common"
+	"stress/dedup"
+	"stress/ibsession"
+	"stress/keys"
+	"stress/limit"
+	"stress/ordering"
+	"stress/registry"
+	"stress/routing"
+	"stress/rules"
+	"stress/schema"
+	"stress/signing"
+	"stress/storage"
 	"strings"
 	"sync"
 	"syscall"
@@ -21,55 +37,34 @@ import (
 type HttpSession struct {
 	httpClient http.Client
 	useSession bool
-	ibSession  string
+	sessions   *ibsession.Pool
 	usr        string
 	pwd        string
-	path       string
 }
 
-func NewSession(path, usr, pwd string, useSession bool) *HttpSession {
+func NewSession(usr, pwd string, useSession bool, sessions *ibsession.Pool, timeouts Timeouts) *HttpSession {
+	transport := &http.Transport{}
+	timeouts.Apply(transport)
 	session := &HttpSession{
 		httpClient: http.Client{
-			Timeout:   1 * time.Second,
-			Transport: &http.Transport{},
+			Timeout:   timeouts.Total,
+			Transport: transport,
 		},
 		useSession: useSession,
-		ibSession:  "",
+		sessions:   sessions,
 		usr:        usr,
 		pwd:        pwd,
-		path:       path,
 	}
 	return session
 }
 
-func (s *HttpSession) NewSession() error {
-	r, _ := http.NewRequest(http.MethodGet, s.path, strings.NewReader(""))
-	r.Header.Add("IBSession", "start")
-	if (s.usr != "") && (s.pwd != "") {
-		r.SetBasicAuth(s.usr, s.pwd)
-	}
-	resp, errReq := s.httpClient.Do(r)
-	if (errReq == nil) && (resp.StatusCode == 200) {
-		s.ibSession = ""
-		for _, cookie := range resp.Cookies() {
-			if cookie.Name == "ibsession" {
-				s.ibSession = cookie.Value
-				break
-			}
-		}
-	} else {
-		s.ibSession = ""
-		return errReq
-	}
-
-	return nil
-}
-
-func (s *HttpSession) TrySend(method string, path string, body string, headers http.Header) (*http.Response, error) {
+// TrySend sends the request, within a 1C session taken from the pool when
+// sessions are in use. The caller must return that session to the pool.
+func (s *HttpSession) TrySend(method string, path string, body string, headers http.Header) (*http.Response, *ibsession.Session, error) {
 	resp, err := http.NewRequest(method, path, strings.NewReader(body))
 
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	for header, values := range headers {
 		for _, value := range values {
@@ -79,16 +74,18 @@ func (s *HttpSession) TrySend(method string, path string, body string, headers h
 	if (s.usr != "") && (s.pwd != "") {
 		resp.SetBasicAuth(s.usr, s.pwd)
 	}
-	if s.useSession && s.ibSession == "" {
-		err := s.NewSession()
+
+	var session *ibsession.Session
+	if s.useSession {
+		session, err = s.sessions.Get(context.Background())
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
+		resp.AddCookie(&http.Cookie{Name: ibsession.CookieName, Value: session.ID})
 	}
-	if s.useSession && s.ibSession != "" {
-		resp.AddCookie(&http.Cookie{Name: "ibsession", Value: s.ibSession})
-	}
-	return s.httpClient.Do(resp)
+
+	result, err := s.httpClient.Do(resp)
+	return result, session, err
 }
 
 type Server struct {
@@ -97,13 +94,35 @@ type Server struct {
 	LogFile   string
 	RequestWG sync.WaitGroup
 	//Stats                *ServerStats
-	done      chan struct{}
-	taskQueue chan *requestTask
+	done         chan struct{}
+	destinations map[string]*Destination
+	destMutex    sync.RWMutex
 	//mutex                sync.Mutex
 	authenticateRequests bool
 	Resend               bool
+	Store                storage.Store
+	Router               *routing.Table
+	Dedup                *dedup.Cache
+	DedupMode            string
+	Ordering             *ordering.Tracker
+	OrderingKeyHeader    string
+	Schemas              *schema.Registry
+	Registry             *registry.Registry
+	Rules                *rules.RuleSet
+	Keys                 *keys.Ring
+	Signing              *signing.Verifier
+	SigningRequired      bool
+	TLSConfig            *tls.Config
+	CertIdentities       map[string]string
+	H2C                  bool
+	Limiter              *limit.Limiter
 }
 
+const (
+	DedupReject = "reject"
+	DedupAck    = "ack"
+)
+
 //type ServerStats struct {
 //	TotalRequests int
 //	StatusCodes   map[int]int
@@ -193,21 +212,62 @@ type Server struct {
 //	}
 //}
 
-func isValidHeader(header string, value []string) bool {
-	switch header {
-	case "x-esb-ver-id":
-		err := uuid.Validate(value[0])
-		return len(value) == 1 && err == nil
-	case "x-esb-ver-no":
-		_, err := time.Parse("20060102T150405", value[0])
-		return len(value) == 1 && err == nil
-	default:
-		return true
+func (s *Server) startMetricsLogger(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.logMetrics()
+		case <-s.done:
+			return
+		}
 	}
 }
 
-func isAuthenticated(value string) bool {
-	return slices.Contains(EsbKeys[:], value)
+func (s *Server) logMetrics() {
+	if s.Resend {
+		s.logDestinationStats()
+	}
+	if s.Dedup != nil {
+		s.Logger.Info().
+			Interface("Statistics", s.Dedup.Stats()).
+			Msg("Dedup statistics")
+	}
+	if s.Ordering != nil {
+		s.Logger.Info().
+			Interface("Statistics", s.Ordering.Stats()).
+			Msg("Ordering statistics")
+	}
+	if s.Schemas != nil {
+		s.Logger.Info().
+			Interface("Statistics", s.Schemas.Stats()).
+			Msg("Schema validation statistics")
+	}
+	if s.authenticateRequests {
+		s.Logger.Info().
+			Interface("Statistics", s.Keys.Stats()).
+			Msg("Key statistics")
+	}
+	if s.Signing != nil {
+		s.Logger.Info().
+			Interface("Statistics", s.Signing.Stats()).
+			Msg("Signature statistics")
+	}
+	if s.Limiter != nil {
+		s.Logger.Info().
+			Interface("Statistics", s.Limiter.Stats()).
+			Msg("Limiter statistics")
+	}
+}
+
+func (s *Server) logKeysReload(count int, err error) {
+	if err != nil {
+		s.Logger.Error().Err(err).Msg("Error reloading keys")
+		return
+	}
+	s.Logger.Info().Int("keys", count).Msg("Keys reloaded")
 }
 
 type requestTask struct {
@@ -226,49 +286,61 @@ func (s *Server) HandleSend(w http.ResponseWriter, r *http.Request) {
 	s.RequestWG.Add(1)
 	defer s.RequestWG.Done()
 
-	for _, name := range RequiredHeaders {
-		if name == "x-esb-ver-id" || name == "x-esb-ver-no" {
-			continue
-		}
-		if name == "x-esb-key" && !s.authenticateRequests {
-			continue
-		}
-		header := r.Header.Get(name)
+	correlationID := r.Header.Get(CorrelationHeader)
+	if correlationID == "" {
+		correlationID = uuid.New().String()
+	}
+	w.Header().Set(CorrelationHeader, correlationID)
+	logger := s.Logger.With().Str("correlation_id", correlationID).Logger()
 
-		if header == "" {
-			w.WriteHeader(http.StatusBadRequest)
-			s.Logger.Error().
-				Str("header", name).
-				Int("status", http.StatusBadRequest).
-				Msg("Missing required header")
+	if s.Limiter != nil {
+		release, err := s.Limiter.Acquire(r.Context(), r.Header.Get("x-esb-src"), r.Header.Get("x-esb-key"))
+		if err != nil {
+			var limitErr *limit.Error
+			if !errors.As(err, &limitErr) {
+				logger.Warn().Err(err).Msg("Request canceled while waiting for limiter")
+				return
+			}
+			w.Header().Set("Retry-After", limitErr.RetryAfterSeconds())
+			NewProblem(http.StatusTooManyRequests, limitErr.Code, limitErr.Message).WithHeader(limitErr.Header()).Write(w)
+			logger.Warn().
+				Str("code", limitErr.Code).
+				Str("scope", limitErr.Scope).
+				Dur("retry_after", limitErr.RetryAfter).
+				Int("status", http.StatusTooManyRequests).
+				Msg(limitErr.Message)
 			return
 		}
+		defer release()
 	}
 
-	esbKey := r.Header.Get("x-esb-key")
-	if s.authenticateRequests && !isAuthenticated(esbKey) {
-		w.WriteHeader(http.StatusForbidden)
-		s.Logger.Error().
+	if identity, system, ok := s.certSource(r); ok && system != r.Header.Get("x-esb-src") {
+		detail := fmt.Sprintf("Client certificate %q may not send as %q", identity, r.Header.Get("x-esb-src"))
+		NewProblem(http.StatusForbidden, CodeCertificateMismatch, detail).WithHeader("x-esb-src").Write(w)
+		logger.Error().
+			Str("identity", identity).
+			Str("system", system).
 			Int("status", http.StatusForbidden).
-			Msg("Not authenticated")
+			Msg(detail)
 		return
 	}
 
-	for header, value := range r.Header {
-		if !isValidHeader(header, value) {
-			w.WriteHeader(http.StatusBadRequest)
-			s.Logger.Error().
-				Str("header", header).
-				Int("status", http.StatusBadRequest).
-				Msg("Not valid header")
-			return
-		}
+	signed := s.Signing != nil && (s.SigningRequired || r.Header.Get(signing.SignatureHeader) != "")
+
+	if violation := s.Rules.Validate(r.Header, s.authenticateRequests && !signed); violation != nil {
+		NewProblem(violation.Status, violation.Code, violation.Message).WithHeader(violation.Header).Write(w)
+		logger.Error().
+			Str("header", violation.Header).
+			Str("code", violation.Code).
+			Int("status", violation.Status).
+			Msg(violation.Message)
+		return
 	}
 
 	body, err := io.ReadAll(r.Body)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		s.Logger.Error().
+		NewProblem(http.StatusInternalServerError, CodeBodyReadError, "Error reading request body").Write(w)
+		logger.Error().
 			Err(err).
 			Int("status", http.StatusInternalServerError).
 			Msg("Error reading request body")
@@ -276,43 +348,316 @@ func (s *Server) HandleSend(w http.ResponseWriter, r *http.Request) {
 	}
 	defer r.Body.Close()
 
-	if s.Resend {
-		reply := make(chan responseResult, 1)
-		task := &requestTask{
-			headers:   r.Header,
-			body:      body,
-			replyChan: reply,
+	if signed {
+		now := time.Now()
+		src := r.Header.Get("x-esb-src")
+		if err := s.Signing.Verify(r, body, s.Keys.Secrets(src, now), now); err != nil {
+			code, status := CodeNotAuthenticated, http.StatusForbidden
+			var signErr *signing.Error
+			if errors.As(err, &signErr) {
+				code = signErr.Code
+			}
+			if code == signing.CodeNoncesExhausted {
+				status = http.StatusServiceUnavailable
+				w.Header().Set("Retry-After", "1")
+			}
+			NewProblem(status, code, err.Error()).WithHeader(signing.SignatureHeader).Write(w)
+			logger.Error().
+				Str("code", code).
+				Int("status", status).
+				Msg("Invalid request signature")
+			return
+		}
+	} else if s.authenticateRequests {
+		esbKey := r.Header.Get("x-esb-key")
+		if _, err := s.Keys.Authenticate(esbKey, r.Header.Get("x-esb-src"), time.Now()); err != nil {
+			code, header := CodeNotAuthenticated, "x-esb-key"
+			var keyErr *keys.Error
+			if errors.As(err, &keyErr) {
+				code = keyErr.Code
+				if code == keys.CodeOwnerMismatch {
+					header = "x-esb-src"
+				}
+			}
+			NewProblem(http.StatusForbidden, code, err.Error()).WithHeader(header).Write(w)
+			logger.Error().
+				Str("key_hash", keys.Hash(esbKey)).
+				Str("code", code).
+				Int("status", http.StatusForbidden).
+				Msg("Not authenticated")
+			return
+		}
+	}
+
+	if s.Registry != nil {
+		for _, check := range []struct {
+			header string
+			err    error
+		}{
+			{"x-esb-src", s.Registry.CheckSource(r.Header.Get("x-esb-src"))},
+			{"x-esb-data-type", s.Registry.CheckDataType(r.Header.Get("x-esb-data-type"))},
+		} {
+			header := check.header
+			var regErr *registry.Error
+			if errors.As(check.err, &regErr) {
+				status := http.StatusBadRequest
+				if regErr.Code != registry.CodeUnknownDataType {
+					status = http.StatusForbidden
+				}
+				NewProblem(status, regErr.Code, regErr.Message).WithHeader(header).Write(w)
+				logger.Error().
+					Str("header", header).
+					Str("code", regErr.Code).
+					Int("status", status).
+					Msg(regErr.Message)
+				return
+			}
+		}
+	}
+
+	if s.Schemas != nil {
+		dataType := r.Header.Get("x-esb-data-type")
+		if errs, known := s.Schemas.Validate(dataType, body); known && len(errs) > 0 {
+			NewProblem(http.StatusUnprocessableEntity, CodeSchemaViolation, "Message body does not match schema of "+dataType).
+				WithHeader("x-esb-data-type").
+				WithErrors(errs).
+				Write(w)
+			logger.Error().
+				Str("data_type", dataType).
+				Interface("errors", errs).
+				Int("status", http.StatusUnprocessableEntity).
+				Msg("Message body does not match schema")
+			return
 		}
+	}
 
-		s.taskQueue <- task
-		resp := <-reply
+	accepted := false
+	verID := r.Header.Get("x-esb-ver-id")
+	if s.Dedup != nil && verID != "" {
+		if s.Dedup.Add(verID) {
+			if s.DedupMode == DedupAck {
+				w.Header().Set(DuplicateHeader, "true")
+				w.WriteHeader(http.StatusOK)
+				logger.Warn().
+					Str("ver_id", verID).
+					Int("status", http.StatusOK).
+					Msg("Duplicate message acknowledged")
+				return
+			}
 
-		if resp.err != nil {
-			s.Logger.Error().Int("status", http.StatusInternalServerError).Msg(resp.err.Error())
-			http.Error(w, resp.err.Error(), http.StatusInternalServerError)
+			NewProblem(http.StatusConflict, CodeDuplicateMessage, "Duplicate message").WithHeader("x-esb-ver-id").Write(w)
+			logger.Error().
+				Str("ver_id", verID).
+				Int("status", http.StatusConflict).
+				Msg("Duplicate message")
 			return
 		}
 
-		s.Logger.Info().
-			Int("status", resp.statusCode).
-			Interface("headers", r.Header).
-			Int64("message_size", r.ContentLength).
-			Str("body", string(resp.body)).
-			Msg("Resend message")
+		defer func() {
+			if !accepted {
+				s.Dedup.Forget(verID)
+			}
+		}()
+	}
+
+	if s.Ordering != nil {
+		if version, err := time.Parse(ordering.VersionLayout, r.Header.Get("x-esb-ver-no")); err == nil {
+			key := ordering.Key{
+				SrcSystem: r.Header.Get("x-esb-src"),
+				DataType:  r.Header.Get("x-esb-data-type"),
+				EntityID:  r.Header.Get(s.OrderingKeyHeader),
+			}
+			ok, latest := s.Ordering.Reserve(key, version)
+			if !ok {
+				// A parked message is neither stored nor delivered, so its
+				// x-esb-ver-id is not kept: a retry is checked again.
+				if s.Ordering.Mode == ordering.ModePark {
+					s.Ordering.Park(ordering.ParkedMessage{
+						Key:     key,
+						VerID:   verID,
+						Version: version,
+						Latest:  latest,
+						Body:    string(body),
+					})
+					w.WriteHeader(http.StatusAccepted)
+					logger.Warn().
+						Str("ver_id", verID).
+						Time("ver_no", version).
+						Time("latest_ver_no", latest).
+						Int("status", http.StatusAccepted).
+						Msg("Stale message parked")
+					return
+				}
+
+				NewProblem(http.StatusConflict, CodeStaleVersion, "Stale message version").WithHeader("x-esb-ver-no").Write(w)
+				logger.Error().
+					Str("ver_id", verID).
+					Time("ver_no", version).
+					Time("latest_ver_no", latest).
+					Int("status", http.StatusConflict).
+					Msg("Stale message version")
+				return
+			}
+
+			defer func() {
+				if accepted {
+					s.Ordering.Commit(key, version)
+				} else {
+					s.Ordering.Release(key)
+				}
+			}()
+		}
+	}
+
+	if s.Store != nil {
+		envelope, _ := json.Marshal(r.Header)
+		saved, err := s.Store.Save(r.Context(), &storage.Message{
+			SrcSystem: r.Header.Get("x-esb-src"),
+			DstSystem: r.Header.Get("x-esb-dst"),
+			DataType:  r.Header.Get("x-esb-data-type"),
+			VerID:     r.Header.Get("x-esb-ver-id"),
+			VerNo:     r.Header.Get("x-esb-ver-no"),
+			Body:      string(body),
+			Envelope:  string(envelope),
+		})
+		if err != nil {
+			NewProblem(http.StatusInternalServerError, CodeStorageError, "Error storing message").Write(w)
+			logger.Error().
+				Err(err).
+				Int("status", http.StatusInternalServerError).
+				Msg("Error storing message")
+			return
+		}
+
+		logger.Info().
+			Str("message_id", saved.MessageID).
+			Strs("channels", saved.Channels).
+			Dur("db_duration", saved.Duration).
+			Msg("Message stored")
+	}
+
+	channels := []string{""}
+	if s.Router != nil {
+		channels = s.Router.Subscribers(routing.Message{
+			SrcSystem: r.Header.Get("x-esb-src"),
+			DstSystem: r.Header.Get("x-esb-dst"),
+			DataType:  r.Header.Get("x-esb-data-type"),
+		})
+		if len(channels) == 0 {
+			logger.Warn().
+				Interface("headers", keys.Redact(r.Header)).
+				Msg("No subscribers for message")
+		}
+	}
+
+	if s.Resend {
+		// With several channels each one is remembered once delivered, so
+		// that a retry of a partly failed message skips the channels that
+		// already have it.
+		perChannel := s.Dedup != nil && verID != "" && len(channels) > 1
+		replies := make([]chan responseResult, len(channels))
+		for i, channel := range channels {
+			replies[i] = make(chan responseResult, 1)
+			if perChannel && s.Dedup.Add(channelKey(verID, channel)) {
+				logger.Info().
+					Str("ver_id", verID).
+					Str("channel", channel).
+					Msg("Message already delivered to channel")
+				replies[i] <- responseResult{statusCode: http.StatusOK}
+				continue
+			}
+
+			headers := r.Header
+			if channel != "" {
+				headers = r.Header.Clone()
+				headers.Set("x-esb-channel", channel)
+			}
+
+			systemID := ""
+			if s.Router != nil {
+				systemID = s.Router.ChannelSystem(channel)
+			}
+			dest, headers, err := s.route(s.destination(systemID), headers)
+			if err != nil {
+				replies[i] <- responseResult{err: err}
+				continue
+			}
+
+			dest.Stats.RecordQueued()
+			dest.queue <- &requestTask{
+				headers:   headers,
+				body:      body,
+				replyChan: replies[i],
+			}
+		}
+
+		resp := responseResult{statusCode: http.StatusOK}
+		var deliveryErr error
+		for i, reply := range replies {
+			result := <-reply
+			if perChannel && (result.err != nil || result.statusCode != http.StatusOK) {
+				s.Dedup.Forget(channelKey(verID, channels[i]))
+			}
+
+			if result.err != nil {
+				logger.Error().Str("channel", channels[i]).Msg(result.err.Error())
+				if deliveryErr == nil {
+					deliveryErr = result.err
+				}
+				continue
+			}
+
+			logger.Info().
+				Int("status", result.statusCode).
+				Str("channel", channels[i]).
+				Interface("headers", keys.Redact(r.Header)).
+				Int64("message_size", r.ContentLength).
+				Str("body", string(result.body)).
+				Msg("Resend message")
+
+			if resp.statusCode == http.StatusOK {
+				resp = result
+			}
+		}
+
+		var openErr *breaker.OpenError
+		if errors.As(deliveryErr, &openErr) {
+			w.Header().Set("Retry-After", strconv.Itoa(max(1, int(math.Ceil(openErr.RetryAfter.Seconds())))))
+			NewProblem(http.StatusServiceUnavailable, CodeCircuitOpen, deliveryErr.Error()).Write(w)
+			return
+		}
+		if deliveryErr != nil {
+			NewProblem(http.StatusInternalServerError, CodeDeliveryError, deliveryErr.Error()).Write(w)
+			return
+		}
 
+		accepted = resp.statusCode == http.StatusOK
 		w.WriteHeader(resp.statusCode)
 		w.Write(resp.body)
 	} else {
+		accepted = true
 		w.WriteHeader(http.StatusOK)
 
-		s.Logger.Info().
+		logger.Info().
 			Int("status", http.StatusOK).
-			Interface("headers", r.Header).
+			Strs("channels", channels).
+			Interface("headers", keys.Redact(r.Header)).
 			Int64("message_size", r.ContentLength).
 			Msg("Resend message")
 	}
 }
 
+// HandleParked lists the stale messages parked by the ordering tracker.
+func (s *Server) HandleParked(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.Ordering.Parked())
+}
+
+// channelKey is the dedup key of a message delivered to one channel.
+func channelKey(verID, channel string) string {
+	return verID + "@" + channel
+}
+
 func (s *Server) Run() error {
 	//http.HandleFunc("/send/", s.RequestStatsMiddleware(s.HandleSend))
 	//http.HandleFunc("/send", s.RequestStatsMiddleware(s.HandleSend))
@@ -323,14 +668,30 @@ func (s *Server) Run() error {
 	http.HandleFunc("/send", s.HandleSend)
 	http.HandleFunc("/msg/", s.HandleSend)
 	http.HandleFunc("/msg", s.HandleSend)
+	if s.Ordering != nil {
+		http.HandleFunc("GET /ordering/parked", s.HandleParked)
+	}
 
 	s.Logger.Info().
 		Int("port", s.Port).
+		Bool("tls", s.TLSConfig != nil).
+		Bool("h2c", s.H2C).
 		Msg("Starting server")
 
 	//go s.startStatsLogger(5 * time.Second)
+	go s.startMetricsLogger(5 * time.Second)
 
-	return http.ListenAndServe(fmt.Sprintf(":%d", s.Port), nil)
+	server := &http.Server{Addr: fmt.Sprintf(":%d", s.Port), TLSConfig: s.TLSConfig}
+	if s.H2C {
+		server.Protocols = new(http.Protocols)
+		server.Protocols.SetHTTP1(true)
+		server.Protocols.SetHTTP2(true)
+		server.Protocols.SetUnencryptedHTTP2(true)
+	}
+	if s.TLSConfig != nil {
+		return server.ListenAndServeTLS("", "")
+	}
+	return server.ListenAndServe()
 }
 
 func (s *Server) Shutdown() {
@@ -339,6 +700,20 @@ func (s *Server) Shutdown() {
 	s.RequestWG.Wait()
 
 	close(s.done)
+	s.logMetrics()
+	s.closeSessions()
+
+	if s.Store != nil {
+		if err := s.Store.Close(); err != nil {
+			s.Logger.Error().Err(err).Msg("Error closing storage")
+		}
+	}
+
+	if s.Dedup != nil {
+		if err := s.Dedup.Close(); err != nil {
+			s.Logger.Error().Err(err).Msg("Error closing dedup cache")
+		}
+	}
 
 	s.Logger.Info().Msg("Server shutdown complete")
 
@@ -375,35 +750,53 @@ func getAuthEnvVar() bool {
 	return authDefaultValue
 }
 
-func (s *Server) workerLoop(sess *HttpSession) {
-	for task := range s.taskQueue {
-		responseBody := string(task.body)
-		resp, err := sess.TrySend(http.MethodPost, urlMsg, responseBody, task.headers)
-		result := responseResult{}
-
-		if err == nil {
-			responceText, _ := io.ReadAll(resp.Body)
-			if resp.StatusCode != 200 { //&& s.useSession {
-				if (strings.Contains(string(responceText), "Ошибка работы сеанса")) ||
-					(strings.Contains(string(responceText), "Session error")) {
-					sess.ibSession = ""
-					sess.useSession = true
-					resp, err = sess.TrySend(http.MethodPost, urlMsg, responseBody, task.headers)
-					if err == nil {
-						responceText, _ = io.ReadAll(resp.Body)
-					}
-				}
+func (s *Server) workerLoop(dest *Destination, sess *HttpSession) {
+	for task := range dest.queue {
+		// Tasks queued before the circuit opened are routed like new ones,
+		// to the dead letter destination when there is one.
+		if dest.Breaker != nil && dest.Breaker.Open() {
+			target, headers, err := s.route(dest, task.headers)
+			if err != nil {
+				task.replyChan <- responseResult{err: err}
+				continue
 			}
-			result.statusCode = resp.StatusCode
-			result.body, _ = io.ReadAll(resp.Body)
-			resp.Body.Close()
+			if target != dest {
+				task.headers = headers
+				target.Stats.RecordQueued()
+				target.queue <- task
+				continue
+			}
+		}
+
+		startTime := time.Now()
+		result := dest.send(sess, task)
 
+		for attempt := 1; attempt <= dest.Config.Retries && result.retryable(); attempt++ {
+			if dest.Breaker != nil && dest.Breaker.Open() {
+				break
+			}
+			dest.Stats.RecordRetry()
+			s.Logger.Warn().
+				Str("destination", dest.Name()).
+				Int("attempt", attempt).
+				Int("status", result.statusCode).
+				AnErr("error", result.err).
+				Msg("Retrying delivery")
+			time.Sleep(dest.Config.RetryDelay)
+			result = dest.send(sess, task)
 		}
 
-		result.err = err
+		dest.Stats.RecordDelivery(!result.retryable(), time.Since(startTime))
+		if dest.Breaker != nil {
+			dest.Breaker.Record(!result.retryable())
+		}
+		if result.err != nil {
+			dest.Stats.RecordError(ClassifyError(result.err, ""))
+		}
 		task.replyChan <- result
 	}
 }
+
 func NewServer(port int, logFile string, authenticate bool, resend bool, numWorkers int) (*Server, error) {
 	logger, err := NewLogger(logFile)
 	if err != nil {
@@ -419,12 +812,30 @@ func NewServer(port int, logFile string, authenticate bool, resend bool, numWork
 		//	StatusCodes: make(map[int]int),
 		//},
 		done:                 make(chan struct{}),
-		taskQueue:            make(chan *requestTask, numWorkers*2),
+		destinations:         make(map[string]*Destination),
 		authenticateRequests: authenticate,
+		Rules:                rules.Default(),
 	}
 
-	for i := 0; i < numWorkers; i++ {
-		go s.workerLoop(NewSession(urlInfo, "esb", "esb", s.Resend))
+	var defaultKeys []keys.Key
+	for _, key := range EsbKeys {
+		defaultKeys = append(defaultKeys, keys.Key{Key: key})
+	}
+	s.Keys, err = keys.NewRing("", defaultKeys)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load keys: %w", err)
+	}
+
+	_, err = s.AddDestination(DestinationConfig{
+		MsgUrl:     urlMsg,
+		InfoUrl:    urlInfo,
+		User:       "esb",
+		Password:   "esb",
+		UseSession: s.Resend,
+		Workers:    numWorkers,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to add destination: %w", err)
 	}
 
 	return s, nil
@@ -437,7 +848,45 @@ func main() {
 	port := flag.Int("port", 8080, "Server port")
 	logFile := flag.String("log", "server.json", "Path to log file")
 	authenticate := flag.Bool("auth", getAuthEnvVar(), "Authenticate HTTP requests")
-	resend := flag.Bool("resend", false, "Authenticate HTTP requests")
+	resend := flag.Bool("resend", false, "Deliver accepted messages to their destinations")
+	dbDsn := flag.String("db", os.Getenv("DATABASE_URL"), "PostgreSQL connection string for message storage")
+	dbConns := flag.Int("db-conns", 10, "Maximum open database connections")
+	routesFile := flag.String("routes", "", "Path to YAML routing table")
+	routesDB := flag.Bool("routes-db", false, "Load routing table from the database")
+	destinationsFile := flag.String("destinations", "", "Path to YAML destinations file")
+	dedupMode := flag.String("dedup", "", "Duplicate x-esb-ver-id handling: reject (409) or ack (200 without resend)")
+	dedupSize := flag.Int("dedup-size", 100000, "Maximum number of remembered x-esb-ver-id values")
+	dedupTTL := flag.Duration("dedup-ttl", 10*time.Minute, "How long an x-esb-ver-id is remembered")
+	dedupFile := flag.String("dedup-file", "", "Path to file persisting remembered x-esb-ver-id values")
+	orderingMode := flag.String("ordering", "", "Out-of-order x-esb-ver-no handling: track, reject (409) or park (202)")
+	orderingParkSize := flag.Int("ordering-park-size", 10000, "Maximum number of parked stale messages, listed at /ordering/parked")
+	orderingEntities := flag.Int("ordering-entities", 100000, "Maximum number of entities whose latest x-esb-ver-no is kept")
+	orderingKeyHeader := flag.String("ordering-key-header", "x-esb-ids", "Header identifying the entity a message versions")
+	schemaDir := flag.String("schemas", "", "Path to directory with XML/JSON schemas of data types")
+	registryFile := flag.String("registry", "", "Path to YAML registry of systems and data types")
+	rulesFile := flag.String("rules", "", "Path to YAML header validation rules")
+	registryDB := flag.Bool("registry-db", false, "Load registry of systems and data types from the database")
+	keysFile := flag.String("keys", os.Getenv("ESB_KEYS_FILE"), "Path to YAML file with x-esb-key values, reloaded on change")
+	keysRegistry := flag.Bool("keys-registry", false, "Accept the keys held in systems.addr of the registry, bound to their system")
+	signingMode := flag.String("signing", os.Getenv("SIGNING"), "HMAC request signatures: optional (verified when present) or required")
+	signingSkew := flag.Duration("signing-skew", 5*time.Minute, "Allowed clock skew of signed requests")
+	signingNonces := flag.Int("signing-nonces", 100000, "Maximum number of remembered signature nonces, signed requests get 503 while all are within twice the skew")
+	tlsCert := flag.String("tls-cert", os.Getenv("TLS_CERT"), "Path to TLS certificate, enables HTTPS")
+	tlsKey := flag.String("tls-key", os.Getenv("TLS_KEY"), "Path to TLS private key")
+	tlsClientCA := flag.String("tls-client-ca", os.Getenv("TLS_CLIENT_CA"), "Path to CA of client certificates, enables mutual TLS")
+	h2c := flag.Bool("h2c", false, "Accept HTTP/2 without TLS (h2c)")
+	tlsIdentities := flag.String("tls-identities", "", "Path to YAML mapping of client certificate identities to source systems")
+	keysReload := flag.Duration("keys-reload", 10*time.Second, "How often the keys file is checked for changes")
+	breakerRatio := flag.Float64("breaker-ratio", 0, "Failure ratio that opens the circuit breaker of a destination, 0 to disable")
+	breakerWindow := flag.Duration("breaker-window", 10*time.Second, "Window over which the circuit breaker failure ratio is measured")
+	breakerMinRequests := flag.Int("breaker-min-requests", 10, "Minimum number of requests in the window before the circuit breaker may open")
+	breakerOpenFor := flag.Duration("breaker-open", 5*time.Second, "How long an open circuit rejects requests before probing the destination")
+	breakerOnOpen := flag.String("breaker-on-open", breaker.OnOpenFail, "Handling of requests while the circuit is open: fail (503) or dlq")
+	limitsFile := flag.String("limits", "", "Path to YAML rate and concurrency limits")
+	rate := flag.Float64("rate", 0, "Global rate limit in requests per second, 0 to disable")
+	burst := flag.Int("burst", 0, "Burst size of the global rate limit")
+	maxInFlight := flag.Int("max-in-flight", 0, "Maximum number of requests in flight, 0 to disable")
+	limitWait := flag.Duration("limit-wait", 0, "How long a request over the limits waits before it is rejected with 429")
 	flag.Parse()
 
 	server, err := NewServer(*port, *logFile, *authenticate, *resend, 1)
@@ -446,6 +895,203 @@ func main() {
 		os.Exit(1)
 	}
 
+	var destinations []DestinationConfig
+	if *dbDsn != "" {
+		store, err := storage.NewPostgresStore(*dbDsn, *dbConns)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error creating storage: %v\n", err)
+			os.Exit(1)
+		}
+		server.Store = store
+
+		if *registryDB {
+			server.Registry, err = registry.LoadDB(context.Background(), store.DB())
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error loading registry: %v\n", err)
+				os.Exit(1)
+			}
+		}
+
+		if *routesDB {
+			server.Router, err = routing.LoadDB(context.Background(), store.DB())
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error loading routing table: %v\n", err)
+				os.Exit(1)
+			}
+
+			destinations, err = loadDestinationsDB(context.Background(), store.DB(), DestinationConfig{
+				User:       "esb",
+				Password:   "esb",
+				UseSession: *resend,
+			})
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error loading destinations: %v\n", err)
+				os.Exit(1)
+			}
+		}
+	}
+
+	if *routesFile != "" {
+		server.Router, err = routing.LoadFile(*routesFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error loading routing table: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if *destinationsFile != "" {
+		fileDestinations, err := loadDestinations(*destinationsFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error loading destinations: %v\n", err)
+			os.Exit(1)
+		}
+		destinations = mergeDestinations(destinations, fileDestinations)
+	}
+	for _, destination := range destinations {
+		if _, err := server.AddDestination(destination); err != nil {
+			fmt.Fprintf(os.Stderr, "Error adding destination: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if *breakerRatio > 0 {
+		err = server.SetDefaultBreaker(breaker.Config{
+			FailureRatio: *breakerRatio,
+			Window:       *breakerWindow,
+			MinRequests:  *breakerMinRequests,
+			OpenFor:      *breakerOpenFor,
+			OnOpen:       *breakerOnOpen,
+		})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error creating circuit breaker: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	if err := server.CheckDLQs(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error configuring circuit breakers: %v\n", err)
+		os.Exit(1)
+	}
+
+	switch *dedupMode {
+	case "":
+	case DedupReject, DedupAck:
+		server.Dedup, err = dedup.NewCache(*dedupSize, *dedupTTL, *dedupFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error creating dedup cache: %v\n", err)
+			os.Exit(1)
+		}
+		server.DedupMode = *dedupMode
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown dedup mode: %s\n", *dedupMode)
+		os.Exit(1)
+	}
+
+	if *rulesFile != "" {
+		server.Rules, err = rules.Load(*rulesFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error loading header rules: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if *registryFile != "" {
+		server.Registry, err = registry.LoadFile(*registryFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error loading registry: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	var staticKeys []keys.Key
+	if *keysRegistry {
+		if server.Registry == nil {
+			fmt.Fprintf(os.Stderr, "Error loading keys: -keys-registry requires a registry\n")
+			os.Exit(1)
+		}
+		staticKeys = append(staticKeys, keys.FromRegistry(server.Registry)...)
+	}
+	staticKeys = append(staticKeys, keys.ParseEnv(os.Getenv("ESB_KEYS"))...)
+	if *keysFile != "" || len(staticKeys) > 0 {
+		server.Keys, err = keys.NewRing(*keysFile, staticKeys)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error loading keys: %v\n", err)
+			os.Exit(1)
+		}
+		go server.Keys.Watch(*keysReload, server.done, server.logKeysReload)
+	}
+
+	if *tlsCert != "" {
+		server.TLSConfig, err = NewServerTLSConfig(*tlsCert, *tlsKey, *tlsClientCA)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error loading TLS configuration: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	server.H2C = *h2c
+
+	if *tlsIdentities != "" {
+		server.CertIdentities, err = loadCertIdentities(*tlsIdentities)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error loading certificate identities: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	switch *signingMode {
+	case "":
+	case "optional", "required":
+		server.Signing, err = signing.NewVerifier(*signingSkew, *signingNonces)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error creating signature verifier: %v\n", err)
+			os.Exit(1)
+		}
+		server.SigningRequired = *signingMode == "required"
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown signing mode: %s\n", *signingMode)
+		os.Exit(1)
+	}
+
+	if *schemaDir != "" {
+		server.Schemas, err = schema.Load(*schemaDir)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error loading schemas: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	switch *orderingMode {
+	case "":
+	case ordering.ModeTrack, ordering.ModeReject, ordering.ModePark:
+		server.Ordering = ordering.NewTracker(*orderingMode, *orderingEntities, *orderingParkSize)
+		server.OrderingKeyHeader = *orderingKeyHeader
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown ordering mode: %s\n", *orderingMode)
+		os.Exit(1)
+	}
+
+	var limits limit.Config
+	if *limitsFile != "" {
+		limits, err = limit.LoadConfig(*limitsFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error loading limits: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	if *rate > 0 {
+		limits.Global.Rate = *rate
+		limits.Global.Burst = *burst
+	}
+	if *maxInFlight > 0 {
+		limits.Global.MaxInFlight = *maxInFlight
+	}
+	if *limitWait > 0 {
+		limits.Wait = *limitWait
+	}
+	if *limitsFile != "" || *rate > 0 || *maxInFlight > 0 {
+		server.Limiter = limit.NewLimiter(limits)
+	}
+
 	setupSignalHandler(server)
 
 	err = server.Run()
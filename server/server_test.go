@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	. "stress/common"
+	"stress/schema"
+)
+
+func TestHandleSendSchemaViolation(t *testing.T) {
+	s, err := NewServer(0, filepath.Join(t.TempDir(), "server.json"), false, false, 1)
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	s.Schemas, err = schema.Load("../schemas")
+	if err != nil {
+		t.Fatalf("schema.Load: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		body   string
+		status int
+		paths  []string
+	}{
+		{
+			name:   "valid",
+			body:   `{"id": "1", "timestamp": "2024-01-02T03:04:05Z", "payload": "abc"}`,
+			status: http.StatusOK,
+		},
+		{
+			name:   "json",
+			body:   `{"id": "", "timestamp": "2024-01-02T03:04:05Z", "payload": 5}`,
+			status: http.StatusUnprocessableEntity,
+			paths:  []string{"/payload", "/id"},
+		},
+		{
+			name:   "xml",
+			body:   `<sku><id>1</id><timestamp>yesterday</timestamp><payload>abc</payload><extra/></sku>`,
+			status: http.StatusUnprocessableEntity,
+			paths:  []string{"/sku/timestamp", "/sku/extra"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/msg", strings.NewReader(tt.body))
+			r.Header.Set("x-esb-src", "sys:erp")
+			r.Header.Set("x-esb-data-type", "ref:sku")
+			r.Header.Set(CorrelationHeader, "test")
+			w := httptest.NewRecorder()
+
+			s.HandleSend(w, r)
+
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			if tt.status == http.StatusOK {
+				return
+			}
+			if ct := w.Header().Get("Content-Type"); ct != ProblemContentType {
+				t.Errorf("Content-Type = %q, want %q", ct, ProblemContentType)
+			}
+
+			var problem struct {
+				Problem
+				Errors []schema.Error `json:"errors"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &problem); err != nil {
+				t.Fatalf("decoding problem: %v", err)
+			}
+			if problem.Status != http.StatusUnprocessableEntity || problem.Code != CodeSchemaViolation ||
+				problem.Header != "x-esb-data-type" || problem.CorrelationID != "test" {
+				t.Errorf("problem = %+v", problem.Problem)
+			}
+			if len(problem.Errors) != len(tt.paths) {
+				t.Fatalf("errors = %+v, want paths %v", problem.Errors, tt.paths)
+			}
+			for i, e := range problem.Errors {
+				if e.Path != tt.paths[i] || e.Message == "" {
+					t.Errorf("errors[%d] = %+v, want path %s", i, e, tt.paths[i])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+
+	. "stress/common"
+
+	"gopkg.in/yaml.v3"
+)
+
+func loadCertIdentities(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read identities file: %w", err)
+	}
+
+	var file struct {
+		Identities map[string]string `yaml:"identities"`
+	}
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("failed to parse identities file: %w", err)
+	}
+	return file.Identities, nil
+}
+
+// certSource returns the identity of the client certificate of the request and
+// the source system it maps to, which is empty for an unmapped identity.
+// Without an identities mapping the certificate identity itself is the system
+// ID. The last result is false for requests without a client certificate.
+func (s *Server) certSource(r *http.Request) (string, string, bool) {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return "", "", false
+	}
+
+	identity := CertIdentity(r.TLS.PeerCertificates[0])
+	if s.CertIdentities == nil {
+		return identity, identity, true
+	}
+	return identity, s.CertIdentities[identity], true
+}
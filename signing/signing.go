@@ -0,0 +1,183 @@
+package signing
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"stress/dedup"
+)
+
+const (
+	TimestampHeader = "x-esb-timestamp"
+	NonceHeader     = "x-esb-nonce"
+	SignatureHeader = "x-esb-signature"
+)
+
+type Error struct {
+	Code    string
+	Message string
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+const (
+	CodeMissingSignature = "missing_signature"
+	CodeInvalidSignature = "invalid_signature"
+	CodeClockSkew        = "clock_skew"
+	CodeReplayedNonce    = "replayed_nonce"
+	CodeNoncesExhausted  = "nonces_exhausted"
+)
+
+// StringToSign is the canonical form of a request covered by the signature:
+// method, path, timestamp, nonce, x-esb-ver-id and the SHA-256 of the body,
+// one per line.
+func StringToSign(method, path, timestamp, nonce, verID string, body []byte) string {
+	bodyHash := sha256.Sum256(body)
+	return strings.Join([]string{
+		strings.ToUpper(method),
+		path,
+		timestamp,
+		nonce,
+		verID,
+		hex.EncodeToString(bodyHash[:]),
+	}, "\n")
+}
+
+func signature(secret, stringToSign string) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(stringToSign))
+	return mac.Sum(nil)
+}
+
+// Sign sets the timestamp, nonce and signature headers of the request.
+func Sign(req *http.Request, body []byte, secret string, now time.Time) error {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return fmt.Errorf("failed to generate nonce: %w", err)
+	}
+
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+	nonceHex := hex.EncodeToString(nonce)
+	stringToSign := StringToSign(req.Method, req.URL.Path, timestamp, nonceHex, req.Header.Get("x-esb-ver-id"), body)
+
+	req.Header.Set(TimestampHeader, timestamp)
+	req.Header.Set(NonceHeader, nonceHex)
+	req.Header.Set(SignatureHeader, hex.EncodeToString(signature(secret, stringToSign)))
+	return nil
+}
+
+// Verifier checks request signatures. A nonce is remembered for twice the
+// allowed clock skew, which covers every timestamp that is still accepted.
+// Forgetting one earlier would let its request be replayed, so while the
+// nonce cache is full signed requests are refused instead.
+type Verifier struct {
+	Skew          time.Duration
+	nonces        *dedup.Cache
+	verified      int
+	rejected      map[string]int
+	totalDuration time.Duration
+	mutex         sync.Mutex
+}
+
+func NewVerifier(skew time.Duration, nonceCapacity int) (*Verifier, error) {
+	nonces, err := dedup.NewCache(nonceCapacity, 2*skew, "")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create nonce cache: %w", err)
+	}
+
+	return &Verifier{
+		Skew:     skew,
+		nonces:   nonces,
+		rejected: make(map[string]int),
+	}, nil
+}
+
+// Verify checks the signature of the request against each of the secrets, so
+// that keys overlapping during a rotation are all accepted.
+func (v *Verifier) Verify(r *http.Request, body []byte, secrets []string, now time.Time) error {
+	startTime := time.Now()
+	err := v.verify(r, body, secrets, now)
+	duration := time.Since(startTime)
+
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	v.totalDuration += duration
+	if err != nil {
+		v.rejected[err.Code]++
+		return err
+	}
+	v.verified++
+	return nil
+}
+
+func (v *Verifier) verify(r *http.Request, body []byte, secrets []string, now time.Time) *Error {
+	timestamp := r.Header.Get(TimestampHeader)
+	nonce := r.Header.Get(NonceHeader)
+	provided, err := hex.DecodeString(r.Header.Get(SignatureHeader))
+	if timestamp == "" || nonce == "" || len(provided) == 0 || err != nil {
+		return &Error{Code: CodeMissingSignature, Message: "Missing or malformed request signature"}
+	}
+
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return &Error{Code: CodeInvalidSignature, Message: "Malformed " + TimestampHeader}
+	}
+	if skew := now.Sub(time.Unix(seconds, 0)); skew > v.Skew || skew < -v.Skew {
+		return &Error{Code: CodeClockSkew, Message: fmt.Sprintf("Request timestamp is %v off the server clock", skew.Round(time.Second))}
+	}
+
+	stringToSign := StringToSign(r.Method, r.URL.Path, timestamp, nonce, r.Header.Get("x-esb-ver-id"), body)
+	valid := false
+	for _, secret := range secrets {
+		if hmac.Equal(provided, signature(secret, stringToSign)) {
+			valid = true
+			break
+		}
+	}
+	if !valid {
+		return &Error{Code: CodeInvalidSignature, Message: "Request signature does not match"}
+	}
+
+	duplicate, full := v.nonces.AddIfRoom(r.Header.Get("x-esb-src") + " " + nonce)
+	if duplicate {
+		return &Error{Code: CodeReplayedNonce, Message: "Request nonce has already been used"}
+	}
+	if full {
+		return &Error{Code: CodeNoncesExhausted, Message: "Too many signed requests within the nonce lifetime"}
+	}
+	return nil
+}
+
+func (v *Verifier) Stats() map[string]interface{} {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	rejected := make(map[string]int, len(v.rejected))
+	total := v.verified
+	for code, count := range v.rejected {
+		rejected[code] = count
+		total += count
+	}
+
+	avgDuration := time.Duration(0)
+	if total > 0 {
+		avgDuration = time.Duration(int64(v.totalDuration) / int64(total))
+	}
+
+	return map[string]interface{}{
+		"Verified":        v.verified,
+		"Rejected":        rejected,
+		"AverageDuration": avgDuration,
+	}
+}
@@ -0,0 +1,183 @@
+package signing
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const secret = "secret"
+
+func signedRequest(t *testing.T, body string, now time.Time) *http.Request {
+	t.Helper()
+	r := httptest.NewRequest(http.MethodPost, "/msg", strings.NewReader(body))
+	r.Header.Set("x-esb-src", "sys:erp")
+	r.Header.Set("x-esb-ver-id", "4d7f5c1e-3b0a-4a6b-9a55-2f7a0d3c1e01")
+	if err := Sign(r, []byte(body), secret, now); err != nil {
+		t.Fatalf("Sign: %v", err)
+	}
+	return r
+}
+
+func newVerifier(t *testing.T, nonces int) *Verifier {
+	t.Helper()
+	v, err := NewVerifier(time.Minute, nonces)
+	if err != nil {
+		t.Fatalf("NewVerifier: %v", err)
+	}
+	return v
+}
+
+func code(err error) string {
+	var signErr *Error
+	if errors.As(err, &signErr) {
+		return signErr.Code
+	}
+	return ""
+}
+
+func TestVerify(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name    string
+		request func() *http.Request
+		body    string
+		secrets []string
+		want    string
+	}{
+		{
+			name:    "valid",
+			request: func() *http.Request { return signedRequest(t, "body", now) },
+			body:    "body",
+			secrets: []string{secret},
+		},
+		{
+			name:    "valid with a rotated secret",
+			request: func() *http.Request { return signedRequest(t, "body", now) },
+			body:    "body",
+			secrets: []string{"new secret", secret},
+		},
+		{
+			name:    "wrong secret",
+			request: func() *http.Request { return signedRequest(t, "body", now) },
+			body:    "body",
+			secrets: []string{"other"},
+			want:    CodeInvalidSignature,
+		},
+		{
+			name:    "tampered body",
+			request: func() *http.Request { return signedRequest(t, "body", now) },
+			body:    "tampered",
+			secrets: []string{secret},
+			want:    CodeInvalidSignature,
+		},
+		{
+			name: "tampered ver-id",
+			request: func() *http.Request {
+				r := signedRequest(t, "body", now)
+				r.Header.Set("x-esb-ver-id", "other")
+				return r
+			},
+			body:    "body",
+			secrets: []string{secret},
+			want:    CodeInvalidSignature,
+		},
+		{
+			name: "tampered path",
+			request: func() *http.Request {
+				r := signedRequest(t, "body", now)
+				r.URL.Path = "/send"
+				return r
+			},
+			body:    "body",
+			secrets: []string{secret},
+			want:    CodeInvalidSignature,
+		},
+		{
+			name: "missing signature",
+			request: func() *http.Request {
+				r := signedRequest(t, "body", now)
+				r.Header.Del(SignatureHeader)
+				return r
+			},
+			body:    "body",
+			secrets: []string{secret},
+			want:    CodeMissingSignature,
+		},
+		{
+			name: "malformed timestamp",
+			request: func() *http.Request {
+				r := signedRequest(t, "body", now)
+				r.Header.Set(TimestampHeader, "yesterday")
+				return r
+			},
+			body:    "body",
+			secrets: []string{secret},
+			want:    CodeInvalidSignature,
+		},
+		{
+			name:    "timestamp too old",
+			request: func() *http.Request { return signedRequest(t, "body", now.Add(-2*time.Minute)) },
+			body:    "body",
+			secrets: []string{secret},
+			want:    CodeClockSkew,
+		},
+		{
+			name:    "timestamp in the future",
+			request: func() *http.Request { return signedRequest(t, "body", now.Add(2*time.Minute)) },
+			body:    "body",
+			secrets: []string{secret},
+			want:    CodeClockSkew,
+		},
+		{
+			name:    "timestamp within the skew",
+			request: func() *http.Request { return signedRequest(t, "body", now.Add(-30*time.Second)) },
+			body:    "body",
+			secrets: []string{secret},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := newVerifier(t, 10)
+			err := v.Verify(tt.request(), []byte(tt.body), tt.secrets, now)
+			if got := code(err); got != tt.want || (tt.want != "" && err == nil) {
+				t.Errorf("Verify() = %v, want code %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestVerifyReplay(t *testing.T) {
+	now := time.Now()
+	v := newVerifier(t, 10)
+	r := signedRequest(t, "body", now)
+	if err := v.Verify(r, []byte("body"), []string{secret}, now); err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+	if err := v.Verify(r, []byte("body"), []string{secret}, now.Add(time.Second)); code(err) != CodeReplayedNonce {
+		t.Errorf("replayed Verify() = %v, want %s", err, CodeReplayedNonce)
+	}
+
+	stats := v.Stats()
+	if stats["Verified"] != 1 || stats["Rejected"].(map[string]int)[CodeReplayedNonce] != 1 {
+		t.Errorf("Stats() = %v", stats)
+	}
+}
+
+func TestVerifyNoncesExhausted(t *testing.T) {
+	now := time.Now()
+	v := newVerifier(t, 2)
+	for range 2 {
+		if err := v.Verify(signedRequest(t, "body", now), []byte("body"), []string{secret}, now); err != nil {
+			t.Fatalf("Verify: %v", err)
+		}
+	}
+
+	r := signedRequest(t, "body", now)
+	if err := v.Verify(r, []byte("body"), []string{secret}, now); code(err) != CodeNoncesExhausted {
+		t.Errorf("Verify() with a full nonce cache = %v, want %s", err, CodeNoncesExhausted)
+	}
+}
@@ -0,0 +1,113 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	_ "github.com/lib/pq"
+)
+
+type Message struct {
+	SrcSystem string
+	DstSystem string
+	DataType  string
+	VerID     string
+	VerNo     string
+	Body      string
+	Envelope  string
+}
+
+type Store interface {
+	Save(ctx context.Context, msg *Message) (*SaveResult, error)
+	Close() error
+}
+
+type SaveResult struct {
+	MessageID string
+	Channels  []string
+	Duration  time.Duration
+}
+
+type PostgresStore struct {
+	db *sql.DB
+}
+
+func NewPostgresStore(dsn string, maxConns int) (*PostgresStore, error) {
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database: %w", err)
+	}
+	if maxConns > 0 {
+		db.SetMaxOpenConns(maxConns)
+		db.SetMaxIdleConns(maxConns)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := db.PingContext(ctx); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to connect to database: %w", err)
+	}
+
+	return &PostgresStore{db: db}, nil
+}
+
+const insertMessage = `insert into messages(src_system, dst_system, data_type, ver_id, ver_no, body, envelope)
+values ($1, $2, $3, $4, $5, $6, $7)
+returning message_id`
+
+const enqueueMessage = `insert into queues(channel_id, message_id, queued)
+select s.channel, $1, now() from subscribers($1) as s(channel)
+returning channel_id`
+
+func (s *PostgresStore) Save(ctx context.Context, msg *Message) (*SaveResult, error) {
+	startTime := time.Now()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	result := &SaveResult{}
+	err = tx.QueryRowContext(ctx, insertMessage,
+		msg.SrcSystem, msg.DstSystem, msg.DataType, msg.VerID, msg.VerNo, msg.Body, msg.Envelope,
+	).Scan(&result.MessageID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to insert message: %w", err)
+	}
+
+	rows, err := tx.QueryContext(ctx, enqueueMessage, result.MessageID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to enqueue message: %w", err)
+	}
+	for rows.Next() {
+		var channel string
+		if err := rows.Scan(&channel); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to read queue channel: %w", err)
+		}
+		result.Channels = append(result.Channels, channel)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to enqueue message: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	result.Duration = time.Since(startTime)
+	return result, nil
+}
+
+func (s *PostgresStore) DB() *sql.DB {
+	return s.db
+}
+
+func (s *PostgresStore) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,378 @@
+package verify
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"stress/inbox"
+
+	"github.com/lib/pq"
+)
+
+// Sent records a message as the client sent it. Accepted is set when the
+// service confirmed it.
+type Sent struct {
+	VerID       string
+	MessageID   string
+	PayloadHash string
+	SentAt      time.Time
+	Accepted    bool
+}
+
+// Ledger collects the messages sent during a run, by x-esb-ver-id. Messages
+// without one cannot be matched and are only counted.
+type Ledger struct {
+	sent      map[string]*Sent
+	untracked int
+	mutex     sync.Mutex
+}
+
+func NewLedger() *Ledger {
+	return &Ledger{sent: make(map[string]*Sent)}
+}
+
+func (l *Ledger) Record(sent Sent) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if sent.VerID == "" {
+		l.untracked++
+		return
+	}
+	l.sent[sent.VerID] = &sent
+}
+
+func (l *Ledger) verIDs() []string {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	return slices.Collect(maps.Keys(l.sent))
+}
+
+// Sink is where delivered messages end up.
+type Sink interface {
+	// Receipts returns the deliveries of the messages, and possibly others.
+	Receipts(ctx context.Context, verIDs []string) ([]*inbox.Receipt, error)
+}
+
+// Open selects the sink by its address: the URL of a dumper, a PostgreSQL
+// DSN, or the path of a dumper log file.
+func Open(address string) (Sink, error) {
+	switch {
+	case strings.HasPrefix(address, "http://") || strings.HasPrefix(address, "https://"):
+		return &DumperSink{URL: strings.TrimSuffix(address, "/"), Client: &http.Client{Timeout: time.Minute}}, nil
+	case strings.HasPrefix(address, "postgres://") || strings.HasPrefix(address, "postgresql://"):
+		db, err := sql.Open("postgres", address)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open database: %w", err)
+		}
+		return &PostgresSink{DB: db}, nil
+	default:
+		if _, err := os.Stat(address); err != nil {
+			return nil, fmt.Errorf("failed to open log file: %w", err)
+		}
+		return &LogSink{Path: address}, nil
+	}
+}
+
+// DumperSink queries the API of the dumper.
+type DumperSink struct {
+	URL    string
+	Client *http.Client
+}
+
+// dumperBatchSize keeps the query string of a dumper request short.
+const dumperBatchSize = 100
+
+func (s *DumperSink) Receipts(ctx context.Context, verIDs []string) ([]*inbox.Receipt, error) {
+	var receipts []*inbox.Receipt
+	for batch := range slices.Chunk(verIDs, dumperBatchSize) {
+		found, err := s.query(ctx, batch)
+		if err != nil {
+			return nil, err
+		}
+		receipts = append(receipts, found...)
+	}
+	return receipts, nil
+}
+
+func (s *DumperSink) query(ctx context.Context, verIDs []string) ([]*inbox.Receipt, error) {
+	query := url.Values{"ver_id": verIDs}
+	r, err := http.NewRequestWithContext(ctx, http.MethodGet, s.URL+"/api/messages?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.Client.Do(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query dumper: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to query dumper: status %d", resp.StatusCode)
+	}
+
+	var receipts []*inbox.Receipt
+	if err := json.NewDecoder(resp.Body).Decode(&receipts); err != nil {
+		return nil, fmt.Errorf("failed to decode dumper messages: %w", err)
+	}
+	return receipts, nil
+}
+
+// PostgresSink reads the messages table the server saves to. Copies made by
+// resending a message are not counted as deliveries.
+type PostgresSink struct {
+	DB *sql.DB
+}
+
+const selectMessages = `select ver_id, coalesce(ver_no, ''), coalesce(src_system, ''), coalesce(data_type, ''), coalesce(body, ''),
+       message_created at time zone current_setting('TimeZone')
+from messages
+where ver_id = any($1) and original_id is null
+order by message_created`
+
+const batchSize = 1000
+
+func (s *PostgresSink) Receipts(ctx context.Context, verIDs []string) ([]*inbox.Receipt, error) {
+	var receipts []*inbox.Receipt
+	for batch := range slices.Chunk(verIDs, batchSize) {
+		rows, err := s.DB.QueryContext(ctx, selectMessages, pq.Array(batch))
+		if err != nil {
+			return nil, fmt.Errorf("failed to query messages: %w", err)
+		}
+		for rows.Next() {
+			headers := http.Header{}
+			var verID, verNo, src, dataType, body string
+			var created time.Time
+			if err := rows.Scan(&verID, &verNo, &src, &dataType, &body, &created); err != nil {
+				rows.Close()
+				return nil, fmt.Errorf("failed to read message: %w", err)
+			}
+			headers.Set("x-esb-ver-id", verID)
+			headers.Set("x-esb-ver-no", verNo)
+			headers.Set("x-esb-src", src)
+			headers.Set("x-esb-data-type", dataType)
+			receipts = append(receipts, inbox.NewReceipt(headers, []byte(body), created))
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, fmt.Errorf("failed to query messages: %w", err)
+		}
+	}
+	return receipts, nil
+}
+
+// LogSink reads the receipts logged by the dumper, or a file of receipts it
+// spilled.
+type LogSink struct {
+	Path string
+}
+
+func (s *LogSink) Receipts(ctx context.Context, verIDs []string) ([]*inbox.Receipt, error) {
+	file, err := os.Open(s.Path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open log file: %w", err)
+	}
+	defer file.Close()
+
+	var receipts []*inbox.Receipt
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var line struct {
+			inbox.Receipt
+			Logged *inbox.Receipt `json:"receipt"`
+		}
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			continue
+		}
+		switch {
+		case line.Logged != nil:
+			receipts = append(receipts, line.Logged)
+		case line.VerID != "":
+			receipts = append(receipts, &line.Receipt)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read log file: %w", err)
+	}
+	return receipts, nil
+}
+
+type Latency struct {
+	Count   int
+	Average time.Duration
+	P50     time.Duration
+	P95     time.Duration
+	P99     time.Duration
+	Max     time.Duration
+}
+
+func newLatency(durations []time.Duration) Latency {
+	if len(durations) == 0 {
+		return Latency{}
+	}
+	slices.Sort(durations)
+
+	var total time.Duration
+	for _, d := range durations {
+		total += d
+	}
+	percentile := func(p float64) time.Duration {
+		return durations[int(p*float64(len(durations)-1))]
+	}
+	return Latency{
+		Count:   len(durations),
+		Average: total / time.Duration(len(durations)),
+		P50:     percentile(0.50),
+		P95:     percentile(0.95),
+		P99:     percentile(0.99),
+		Max:     durations[len(durations)-1],
+	}
+}
+
+// Report compares what was sent with what arrived. Lost messages were
+// accepted but never arrived; Unconfirmed ones arrived although the client
+// saw them fail. A message fanned out to several channels is delivered once
+// to each: it is Duplicated when any channel got it more than once, and
+// Reordered when on some channel it arrived after a later message of the same
+// client thread. It is Corrupted when the payload of any delivery differs
+// from the one sent. Latency is measured per channel.
+type Report struct {
+	Sent        int
+	Untracked   int
+	Accepted    int
+	Received    int
+	Lost        []*Sent
+	Duplicated  int
+	Reordered   int
+	Corrupted   []*Sent
+	Unconfirmed int
+	Latency     Latency
+}
+
+func (r *Report) Fields() map[string]interface{} {
+	return map[string]interface{}{
+		"Sent":        r.Sent,
+		"Untracked":   r.Untracked,
+		"Accepted":    r.Accepted,
+		"Received":    r.Received,
+		"Lost":        len(r.Lost),
+		"Duplicated":  r.Duplicated,
+		"Reordered":   r.Reordered,
+		"Corrupted":   len(r.Corrupted),
+		"Unconfirmed": r.Unconfirmed,
+		"Latency":     r.Latency,
+	}
+}
+
+// stream returns the client thread of a message ID of the form
+// <thread>-<number>.
+func stream(messageID string) string {
+	if i := strings.LastIndex(messageID, "-"); i > 0 {
+		return messageID[:i]
+	}
+	return messageID
+}
+
+func (l *Ledger) compare(receipts []*inbox.Receipt) *Report {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	slices.SortStableFunc(receipts, func(a, b *inbox.Receipt) int {
+		return a.ReceivedAt.Compare(b.ReceivedAt)
+	})
+
+	type delivery struct{ verID, channel string }
+	type channelStream struct{ stream, channel string }
+
+	report := &Report{Sent: len(l.sent), Untracked: l.untracked}
+	deliveries := make(map[string][]*inbox.Receipt)
+	perChannel := make(map[delivery]int)
+	duplicated := make(map[string]bool)
+	reordered := make(map[string]bool)
+	latest := make(map[channelStream]time.Time)
+	var latencies []time.Duration
+	for _, receipt := range receipts {
+		sent, ok := l.sent[receipt.VerID]
+		if !ok {
+			continue
+		}
+		deliveries[receipt.VerID] = append(deliveries[receipt.VerID], receipt)
+		key := delivery{receipt.VerID, receipt.Channel}
+		if perChannel[key]++; perChannel[key] > 1 {
+			duplicated[receipt.VerID] = true
+			continue
+		}
+
+		s := channelStream{stream(sent.MessageID), receipt.Channel}
+		if sent.SentAt.Before(latest[s]) {
+			reordered[receipt.VerID] = true
+		} else {
+			latest[s] = sent.SentAt
+		}
+		latencies = append(latencies, receipt.ReceivedAt.Sub(sent.SentAt))
+	}
+	report.Duplicated = len(duplicated)
+	report.Reordered = len(reordered)
+
+	for _, verID := range slices.Sorted(maps.Keys(l.sent)) {
+		sent := l.sent[verID]
+		received := deliveries[verID]
+		if sent.Accepted {
+			report.Accepted++
+		}
+		switch {
+		case len(received) == 0:
+			if sent.Accepted {
+				report.Lost = append(report.Lost, sent)
+			}
+			continue
+		case !sent.Accepted:
+			report.Unconfirmed++
+		}
+		report.Received++
+		for _, receipt := range received {
+			if receipt.PayloadHash != sent.PayloadHash {
+				report.Corrupted = append(report.Corrupted, sent)
+				break
+			}
+		}
+	}
+	report.Latency = newLatency(latencies)
+	return report
+}
+
+// Verify queries the sink for the messages in the ledger. Delivery is
+// asynchronous, so while accepted messages are missing the sink is polled
+// again every interval, for up to wait.
+func Verify(ctx context.Context, sink Sink, ledger *Ledger, wait, interval time.Duration) (*Report, error) {
+	verIDs := ledger.verIDs()
+	deadline := time.Now().Add(wait)
+	for {
+		receipts, err := sink.Receipts(ctx, verIDs)
+		if err != nil {
+			return nil, err
+		}
+		report := ledger.compare(receipts)
+		if len(report.Lost) == 0 || time.Now().Add(interval).After(deadline) {
+			return report, nil
+		}
+
+		select {
+		case <-time.After(interval):
+		case <-ctx.Done():
+			return report, nil
+		}
+	}
+}
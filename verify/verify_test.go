@@ -0,0 +1,156 @@
+package verify
+
+import (
+	"testing"
+	"time"
+
+	"stress/inbox"
+)
+
+var start = time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+func at(n int) time.Time {
+	return start.Add(time.Duration(n) * time.Millisecond)
+}
+
+// ledger records accepted messages 1..n of thread-1, sent a millisecond
+// apart.
+func ledger(n int) *Ledger {
+	l := NewLedger()
+	for i := 1; i <= n; i++ {
+		l.Record(Sent{
+			VerID:       verID(i),
+			MessageID:   "thread-1-" + verID(i),
+			PayloadHash: inbox.PayloadHash(verID(i)),
+			SentAt:      at(i),
+			Accepted:    true,
+		})
+	}
+	return l
+}
+
+func verID(n int) string {
+	return string(rune('a' + n - 1))
+}
+
+func received(n int, channel string, receivedAt time.Time) *inbox.Receipt {
+	return &inbox.Receipt{
+		VerID:       verID(n),
+		Channel:     channel,
+		PayloadHash: inbox.PayloadHash(verID(n)),
+		ReceivedAt:  receivedAt,
+	}
+}
+
+func TestCompare(t *testing.T) {
+	tests := []struct {
+		name     string
+		ledger   func() *Ledger
+		receipts []*inbox.Receipt
+		want     map[string]interface{}
+	}{
+		{
+			name:   "all delivered",
+			ledger: func() *Ledger { return ledger(2) },
+			receipts: []*inbox.Receipt{
+				received(1, "", at(11)),
+				received(2, "", at(12)),
+			},
+			want: map[string]interface{}{"Sent": 2, "Accepted": 2, "Received": 2},
+		},
+		{
+			name:     "lost",
+			ledger:   func() *Ledger { return ledger(2) },
+			receipts: []*inbox.Receipt{received(1, "", at(11))},
+			want:     map[string]interface{}{"Sent": 2, "Accepted": 2, "Received": 1, "Lost": 1},
+		},
+		{
+			name:   "duplicated on a channel",
+			ledger: func() *Ledger { return ledger(1) },
+			receipts: []*inbox.Receipt{
+				received(1, "x", at(11)),
+				received(1, "x", at(12)),
+			},
+			want: map[string]interface{}{"Sent": 1, "Accepted": 1, "Received": 1, "Duplicated": 1},
+		},
+		{
+			name:   "fanned out to channels",
+			ledger: func() *Ledger { return ledger(1) },
+			receipts: []*inbox.Receipt{
+				received(1, "x", at(11)),
+				received(1, "y", at(12)),
+			},
+			want: map[string]interface{}{"Sent": 1, "Accepted": 1, "Received": 1},
+		},
+		{
+			name:   "reordered on a channel",
+			ledger: func() *Ledger { return ledger(2) },
+			receipts: []*inbox.Receipt{
+				received(2, "x", at(11)),
+				received(1, "x", at(12)),
+				received(1, "y", at(13)),
+				received(2, "y", at(14)),
+			},
+			want: map[string]interface{}{"Sent": 2, "Accepted": 2, "Received": 2, "Reordered": 1},
+		},
+		{
+			name:   "corrupted",
+			ledger: func() *Ledger { return ledger(1) },
+			receipts: []*inbox.Receipt{
+				received(1, "x", at(11)),
+				{VerID: verID(1), Channel: "y", PayloadHash: inbox.PayloadHash("other"), ReceivedAt: at(12)},
+			},
+			want: map[string]interface{}{"Sent": 1, "Accepted": 1, "Received": 1, "Corrupted": 1},
+		},
+		{
+			name: "unconfirmed",
+			ledger: func() *Ledger {
+				l := ledger(1)
+				l.Record(Sent{VerID: verID(2), MessageID: "thread-1-b", PayloadHash: inbox.PayloadHash(verID(2)), SentAt: at(2)})
+				l.Record(Sent{VerID: verID(3), MessageID: "thread-1-c", SentAt: at(3)})
+				return l
+			},
+			receipts: []*inbox.Receipt{
+				received(1, "", at(11)),
+				received(2, "", at(12)),
+			},
+			want: map[string]interface{}{"Sent": 3, "Accepted": 1, "Received": 2, "Unconfirmed": 1},
+		},
+		{
+			name: "untracked",
+			ledger: func() *Ledger {
+				l := ledger(1)
+				l.Record(Sent{MessageID: "thread-1-b", SentAt: at(2), Accepted: true})
+				return l
+			},
+			receipts: []*inbox.Receipt{
+				received(1, "", at(11)),
+				{VerID: "unknown", ReceivedAt: at(12)},
+			},
+			want: map[string]interface{}{"Sent": 1, "Untracked": 1, "Accepted": 1, "Received": 1},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fields := tt.ledger().compare(tt.receipts).Fields()
+			for _, name := range []string{"Sent", "Untracked", "Accepted", "Received", "Lost", "Duplicated", "Reordered", "Corrupted", "Unconfirmed"} {
+				want, _ := tt.want[name].(int)
+				if fields[name] != want {
+					t.Errorf("%s = %v, want %d", name, fields[name], want)
+				}
+			}
+		})
+	}
+}
+
+func TestCompareLatency(t *testing.T) {
+	report := ledger(2).compare([]*inbox.Receipt{
+		received(1, "x", at(11)),
+		received(1, "x", at(50)),
+		received(2, "x", at(32)),
+	})
+	// The duplicate is not measured.
+	if report.Latency.Count != 2 || report.Latency.Max != 30*time.Millisecond {
+		t.Errorf("Latency = %+v", report.Latency)
+	}
+}